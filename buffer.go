@@ -0,0 +1,85 @@
+package tinywal
+
+import "io"
+
+// segmentWriter buffers writes to the active segment like bufio.Writer,
+// except that an error isn't sticky: whatever a failed Flush didn't write
+// stays buffered for the next Flush to retry, so records that were already
+// acknowledged are never dropped.
+type segmentWriter struct {
+	file io.Writer
+	buf  []byte
+	// written is the length of the file, including any part of a write
+	// that failed.
+	written int64
+}
+
+// defaultBufferSize is used when Config.BufferSize is zero.
+const defaultBufferSize = 4096
+
+func newSegmentWriter(file io.Writer, size int, written int64) *segmentWriter {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	return &segmentWriter{file: file, buf: make([]byte, 0, size), written: written}
+}
+
+// Write buffers p, flushing first if it doesn't fit. If p is bigger than the
+// whole buffer it goes straight to the file.
+func (s *segmentWriter) Write(p []byte) (int, error) {
+	if len(p) > s.Available() {
+		err := s.Flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(p) > cap(s.buf) {
+		n, err := s.file.Write(p)
+		s.written += int64(n)
+		return n, err
+	}
+	s.buf = append(s.buf, p...)
+	return len(p), nil
+}
+
+func (s *segmentWriter) Flush() error {
+	for len(s.buf) > 0 {
+		n, err := s.file.Write(s.buf)
+		s.written += int64(n)
+		s.buf = s.buf[:copy(s.buf, s.buf[n:])]
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+	}
+	return nil
+}
+
+// Buffered returns how many bytes are waiting to be written.
+func (s *segmentWriter) Buffered() int {
+	return len(s.buf)
+}
+
+// Available returns how many more bytes fit in the buffer.
+func (s *segmentWriter) Available() int {
+	return cap(s.buf) - len(s.buf)
+}
+
+// copyRange returns a copy of the buffered bytes that will land at
+// positions from to to of the file, neither of which may precede written.
+func (s *segmentWriter) copyRange(from, to int64) []byte {
+	return append([]byte(nil), s.buf[from-s.written:to-s.written]...)
+}
+
+// cut drops buffered bytes so the segment ends at size once flushed. It
+// reports false if bytes past size already reached the file.
+func (s *segmentWriter) cut(size int64) bool {
+	if s.written > size {
+		s.buf = s.buf[:0]
+		return false
+	}
+	s.buf = s.buf[:size-s.written]
+	return true
+}
@@ -0,0 +1,54 @@
+package tinywal
+
+import "math"
+
+// CheckpointRecordType is the record type WriteCheckpoint uses. It is
+// reserved; application records shouldn't be written with it.
+const CheckpointRecordType uint16 = math.MaxUint16
+
+// WriteCheckpoint appends a checkpoint record carrying data, typically
+// metadata describing an application snapshot taken at this point.
+func (w *WAL) WriteCheckpoint(data []byte) (uint64, error) {
+	return w.WriteTyped(CheckpointRecordType, data)
+}
+
+// RecoverFromLastCheckpoint replays the most recent intact checkpoint and
+// every record after it, skipping everything before. Checkpoints are
+// delivered with CheckpointRecordType. Without a checkpoint every record is
+// replayed.
+func (w *WAL) RecoverFromLastCheckpoint(callback func(recordType uint16, data []byte) error) error {
+	start, err := w.lastCheckpoint()
+	if err != nil {
+		return err
+	}
+	return w.recoverFrom(start, func(record rawRecord) error {
+		return callback(record.recordType, record.data)
+	})
+}
+
+// lastCheckpoint returns the offset of the newest checkpoint, searching
+// segments newest first, or 0 if there is none.
+func (w *WAL) lastCheckpoint() (uint64, error) {
+	segmentsWithInfo, err := w.snapshotSegments()
+	if err != nil {
+		return 0, err
+	}
+	for i := len(segmentsWithInfo) - 1; i >= 0; i-- {
+		var offset uint64
+		found := false
+		_, err = w.scanSegment(segmentsWithInfo[i], w.recoveryMode, func(record rawRecord) error {
+			if record.recordType == CheckpointRecordType {
+				offset = record.offset
+				found = true
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			return offset, nil
+		}
+	}
+	return 0, nil
+}
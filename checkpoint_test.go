@@ -0,0 +1,64 @@
+package tinywal
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRecoverFromLastCheckpoint(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(128), WithMaxSegments(100))
+	for i := 0; i < 12; i++ {
+		var err error
+		if i%4 == 3 {
+			_, err = w.WriteCheckpoint([]byte(fmt.Sprint("checkpoint ", i)))
+		} else {
+			_, err = w.Write([]byte(fmt.Sprint(i)))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []typedRecord
+	err := w.RecoverFromLastCheckpoint(func(recordType uint16, data []byte) error {
+		got = append(got, typedRecord{recordType, string(data)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []typedRecord{{CheckpointRecordType, "checkpoint 11"}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("records = %v, want %v", got, want)
+	}
+	_, err = w.Write([]byte("12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	err = w.RecoverFromLastCheckpoint(func(recordType uint16, data []byte) error {
+		got = append(got, typedRecord{recordType, string(data)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1].data != "12" {
+		t.Fatalf("records = %v, want the last checkpoint and 12", got)
+	}
+}
+
+func TestRecoverFromLastCheckpointWithoutOne(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()))
+	writeNumbered(t, w, 3)
+	var got []string
+	err := w.RecoverFromLastCheckpoint(func(recordType uint16, data []byte) error {
+		got = append(got, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[0 1 2]" {
+		t.Fatalf("records = %q, want every record", got)
+	}
+}
@@ -0,0 +1,44 @@
+package tinywal
+
+import "time"
+
+// Clock is the WAL's source of time. Tests can supply their own to drive
+// background syncs without sleeping.
+type Clock interface {
+	Now() time.Time
+	NewTicker(period time.Duration) Ticker
+}
+
+// Ticker delivers ticks on C until stopped, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+	// Reset changes the period, counting the next tick from now.
+	Reset(period time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(period time.Duration) Ticker {
+	return realTicker{time.NewTicker(period)}
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+func (t realTicker) Reset(period time.Duration) {
+	t.ticker.Reset(period)
+}
@@ -0,0 +1,238 @@
+package tinywal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when advanced, firing any tickers that fall due.
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	clock  *fakeClock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+	active bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(period time.Duration) Ticker {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ticker := &fakeTicker{
+		clock:  c,
+		c:      make(chan time.Time, 1),
+		period: period,
+		next:   c.now.Add(period),
+		active: true,
+	}
+	c.tickers = append(c.tickers, ticker)
+	return ticker
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	for _, ticker := range c.tickers {
+		if !ticker.active || c.now.Before(ticker.next) {
+			continue
+		}
+		// Like time.Ticker, ticks are dropped for a slow receiver.
+		select {
+		case ticker.c <- c.now:
+		default:
+		}
+		ticker.next = c.now.Add(ticker.period)
+	}
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	t.active = false
+}
+
+func (t *fakeTicker) Reset(period time.Duration) {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	t.period = period
+	t.next = t.clock.now.Add(period)
+	t.active = true
+}
+
+func TestFakeClockDrivesBackgroundSync(t *testing.T) {
+	clock := newFakeClock()
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithClock(clock), WithSyncPeriod(time.Second))
+	_, err := w.Write([]byte("record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(999 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if n := storage.fileSyncs(); n != 0 {
+		t.Fatalf("%d fsyncs before the period elapsed, want 0", n)
+	}
+	clock.Advance(time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for storage.fileSyncs() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("background sync didn't run when the period elapsed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := w.Stats().LastSyncTime; !got.Equal(clock.Now()) {
+		t.Fatalf("LastSyncTime = %v, want the fake clock's %v", got, clock.Now())
+	}
+}
+
+func TestMaxSegmentAgeRotatesWithoutWrites(t *testing.T) {
+	clock := newFakeClock()
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithClock(clock),
+		WithSyncPeriod(time.Second), WithMaxSegmentAge(time.Hour))
+	_, err := w.Write([]byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := w.CurrentSegment()
+	clock.Advance(59 * time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if w.CurrentSegment() != first {
+		t.Fatal("rotated before the segment reached its maximum age")
+	}
+	clock.Advance(time.Minute)
+	deadline := time.Now().Add(time.Second)
+	for w.CurrentSegment() == first {
+		if time.Now().After(deadline) {
+			t.Fatal("background sync didn't rotate the aged segment")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if records := recoverAll(t, w); len(records) != 1 || records[0] != "old" {
+		t.Fatalf("records = %q, want [old]", records)
+	}
+}
+
+func TestSetSyncIntervalChangesCadence(t *testing.T) {
+	clock := newFakeClock()
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithClock(clock), WithSyncPeriod(time.Second))
+	for _, period := range []time.Duration{0, -time.Second} {
+		err := w.SetSyncInterval(period)
+		if !errors.Is(err, ErrInvalidSyncPeriod) {
+			t.Fatalf("SetSyncInterval(%v) = %v, want ErrInvalidSyncPeriod", period, err)
+		}
+	}
+	err := w.SetSyncInterval(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForSyncs := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for storage.fileSyncs() < want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d fsyncs, want %d", storage.fileSyncs(), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		clock.Advance(9 * time.Second)
+		time.Sleep(10 * time.Millisecond)
+		if n := storage.fileSyncs(); n != i-1 {
+			t.Fatalf("%d fsyncs 9s into period %d, want %d", n, i, i-1)
+		}
+		clock.Advance(time.Second)
+		waitForSyncs(i)
+	}
+}
+
+func TestWaitForSync(t *testing.T) {
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithSyncPeriod(5*time.Millisecond))
+	_, err := w.Write([]byte("record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = w.WaitForSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.fileSyncs() == 0 {
+		t.Fatal("WaitForSync returned before an fsync")
+	}
+}
+
+func TestWaitForSyncWaitsForTheNextSync(t *testing.T) {
+	clock := newFakeClock()
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithClock(clock), WithSyncPeriod(time.Second))
+	waited := make(chan error, 1)
+	go func() {
+		waited <- w.WaitForSync(context.Background())
+	}()
+	select {
+	case err := <-waited:
+		t.Fatalf("WaitForSync returned %v before a sync", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForSync didn't return after the sync")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := w.WaitForSync(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	go func() {
+		waited <- w.WaitForSync(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-waited; !errors.Is(err, ErrWALClosed) {
+		t.Fatalf("err = %v after Close, want ErrWALClosed", err)
+	}
+}
+
+func TestWaitForSyncNeedsIntervalMode(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSyncMode(SyncNever))
+	err := w.WaitForSync(context.Background())
+	if !errors.Is(err, ErrInvalidSyncMode) {
+		t.Fatalf("err = %v, want ErrInvalidSyncMode", err)
+	}
+}
@@ -0,0 +1,114 @@
+package tinywal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+const (
+	codecMask     = 0x0f
+	flagEncrypted = 0x10
+)
+
+// Codec compresses record payloads. ID is stored in each compressed record
+// so recovery can pick the matching codec; it must be between 1 and 15 and
+// stay stable for the lifetime of the data. Compress must not modify data.
+type Codec interface {
+	ID() byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+type GzipCodec struct{}
+
+func (GzipCodec) ID() byte {
+	return 1
+}
+
+func (GzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GzipCodec) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+type payloadCodec struct {
+	codec  Codec
+	cipher *recordCipher
+}
+
+// encode compresses and then encrypts data as configured, returning the
+// stored payload and its record flags.
+func (p *payloadCodec) encode(offset uint64, data []byte) ([]byte, byte, error) {
+	var flags byte
+	if p.codec != nil {
+		compressed, err := p.codec.Compress(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(compressed) < len(data) {
+			data = compressed
+			flags = p.codec.ID()
+		}
+	}
+	if p.cipher != nil {
+		var err error
+		data, err = p.cipher.seal(offset, data)
+		if err != nil {
+			return nil, 0, err
+		}
+		flags |= flagEncrypted
+	}
+	return data, flags, nil
+}
+
+func (p *payloadCodec) decode(record rawRecord) ([]byte, error) {
+	data := record.data
+	if record.flags&flagEncrypted != 0 {
+		if p.cipher == nil {
+			return nil, ErrNoEncryptionKey
+		}
+		var err error
+		data, err = p.cipher.open(record.offset, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	id := record.flags & codecMask
+	if id == 0 {
+		return data, nil
+	}
+	codec := p.codec
+	if codec == nil || codec.ID() != id {
+		codec = builtinCodec(id)
+	}
+	if codec == nil {
+		return nil, ErrUnknownCodec
+	}
+	return codec.Decompress(data)
+}
+
+func builtinCodec(id byte) Codec {
+	switch id {
+	case GzipCodec{}.ID():
+		return GzipCodec{}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package tinywal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	compressible := bytes.Repeat([]byte("compress me "), 100)
+	random := make([]byte, 256)
+	_, err := rand.Read(random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := openWAL(t, dir, WithCompression(GzipCodec{}))
+	_, err = w.Write(compressible)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := w.Stats().CurrentSegmentSize
+	if size >= segmentHeaderSize+createdAtSize+encodedSize(len(compressible)) {
+		t.Fatalf("segment is %d bytes, want the record compressed", size)
+	}
+	_, err = w.Write(random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Random bytes don't shrink, so they are stored raw.
+	if grown := w.Stats().CurrentSegmentSize - size; grown != encodedSize(len(random)) {
+		t.Fatalf("random record took %d bytes, want %d", grown, encodedSize(len(random)))
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, dir, WithCompression(GzipCodec{}))
+	records := recoverAll(t, w)
+	if len(records) != 2 || records[0] != string(compressible) || records[1] != string(random) {
+		t.Fatalf("recovered %d records that don't match what was written", len(records))
+	}
+}
+
+func TestCompressedRecordsRecoverWithoutCodec(t *testing.T) {
+	storage := NewMemoryStorage()
+	want := bytes.Repeat([]byte("a"), 1000)
+	w := openWAL(t, "", WithStorage(storage), WithCompression(GzipCodec{}))
+	_, err := w.Write(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, "", WithStorage(storage))
+	records := recoverAll(t, w)
+	if len(records) != 1 || records[0] != string(want) {
+		t.Fatal("built-in gzip records didn't recover without WithCompression")
+	}
+}
+
+func BenchmarkCompressionSavings(b *testing.B) {
+	// Small records don't shrink under gzip, so this is a batch of JSON lines.
+	record := bytes.Repeat([]byte(`{"op":"set","key":"user:1042","value":{"name":"Ada","roles":["admin","editor"]}}`+"\n"), 40)
+	for _, test := range []struct {
+		name string
+		opts []Option
+	}{
+		{"raw", nil},
+		{"gzip", []Option{WithCompression(GzipCodec{})}},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			opts := append([]Option{WithStorage(NewMemoryStorage()), WithNoRetention(true)}, test.opts...)
+			w, err := NewWithOptions("", opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer w.Close()
+			b.SetBytes(int64(len(record)))
+			for i := 0; i < b.N; i++ {
+				_, err := w.Write(record)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			err = w.Sync()
+			if err != nil {
+				b.Fatal(err)
+			}
+			used, err := w.DiskUsage()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(used)/float64(b.N), "disk-bytes/op")
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package tinywal
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// compactSuffix marks a segment written by Compact that hasn't replaced
+	// the original of the same name yet.
+	compactSuffix = ".compact"
+	// compactMarker, after the prefix, names the file that commits a
+	// compaction. It lists the segments the compaction removes.
+	compactMarker = "compact"
+)
+
+// errNoGain stops a compaction that wouldn't leave fewer segments.
+var errNoGain = errors.New("compaction would not reduce segments")
+
+// Compact rewrites the records of the sealed segments densely into as few
+// segments as SegmentSize allows, preserving their offsets, and removes the
+// segments left over. The active segment is untouched. The new segments are
+// staged under temporary names and committed by a marker file, so a crash
+// leaves either the old layout or one that New finishes switching to.
+// Writers wait while Compact runs, and a Reader or Follow started before it
+// may skip or repeat records of the compacted segments.
+func (w *WAL) Compact() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	err := w.writable()
+	if err != nil {
+		return err
+	}
+	segmentsWithInfo, err := w.getSortedSegments()
+	if err != nil {
+		return err
+	}
+	sealed := make([]*segmentInfo, 0, len(segmentsWithInfo))
+	for _, segmentWithInfo := range segmentsWithInfo {
+		if w.removable(segmentWithInfo) {
+			sealed = append(sealed, segmentWithInfo)
+		}
+	}
+	if len(sealed) < 2 {
+		return nil
+	}
+	staged, err := w.stageCompaction(sealed)
+	if err != nil {
+		discardErr := w.finishCompaction()
+		if err == errNoGain {
+			return discardErr
+		}
+		return err
+	}
+	removed := make([]string, 0, len(sealed)-staged)
+	for _, segmentWithInfo := range sealed[staged:] {
+		removed = append(removed, segmentWithInfo.Name)
+	}
+	err = w.commitCompaction(removed)
+	if err != nil {
+		return err
+	}
+	err = w.finishCompaction()
+	if err != nil {
+		return err
+	}
+	w.index.reset()
+	return w.buildIndex()
+}
+
+// stageCompaction copies the records of sealed into temporary segments,
+// each named after the original it will replace, and returns how many it
+// wrote. Records are copied as stored, so compressed and encrypted payloads
+// are not reprocessed.
+func (w *WAL) stageCompaction(sealed []*segmentInfo) (int, error) {
+	var file File
+	var writer *bufio.Writer
+	var size int64
+	staged := 0
+	closeStaged := func() error {
+		err := writer.Flush()
+		if err == nil && !w.disableFsync {
+			err = file.Sync()
+		}
+		if err != nil {
+			file.Close()
+			return diskError(err)
+		}
+		return file.Close()
+	}
+	for _, segmentWithInfo := range sealed {
+		_, err := w.scanSegment(segmentWithInfo, w.recoveryMode, func(record rawRecord) error {
+			if file == nil || size > w.segmentSize {
+				if file != nil {
+					err := closeStaged()
+					file = nil
+					if err != nil {
+						return err
+					}
+				}
+				if staged == len(sealed)-1 {
+					return errNoGain
+				}
+				name := sealed[staged].Name + compactSuffix
+				err := w.storage.Remove(name)
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+				file, err = w.storage.Create(name)
+				if err != nil {
+					return diskError(err)
+				}
+				staged += 1
+				writer = bufio.NewWriterSize(file, w.bufferSize)
+				header := encodeSegmentHeader(w.checksum, w.clock.Now())
+				_, err = writer.Write(header)
+				if err != nil {
+					return diskError(err)
+				}
+				size = int64(len(header))
+			}
+			err := w.encoder.encodeTo(writer, record.offset, record.flags, record.recordType, record.data)
+			if err != nil {
+				return diskError(err)
+			}
+			size += encodedSize(len(record.data))
+			return nil
+		})
+		if err != nil {
+			if file != nil {
+				file.Close()
+			}
+			return staged, err
+		}
+	}
+	if file != nil {
+		err := closeStaged()
+		if err != nil {
+			return staged, err
+		}
+	}
+	return staged, nil
+}
+
+// commitCompaction makes the staged segments durable and then atomically
+// creates the marker listing the segments to remove. From then on the
+// compaction is finished, on reopen if need be, rather than discarded.
+func (w *WAL) commitCompaction(removed []string) error {
+	marker := w.prefix + compactMarker
+	pending := marker + compactSuffix
+	err := w.storage.Remove(pending)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	file, err := w.storage.Create(pending)
+	if err != nil {
+		return diskError(err)
+	}
+	_, err = file.Write([]byte(strings.Join(removed, "\n")))
+	if err == nil && !w.disableFsync {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return diskError(err)
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	err = w.syncStorage()
+	if err != nil {
+		return err
+	}
+	err = w.storage.Rename(pending, marker)
+	if err != nil {
+		return err
+	}
+	return w.syncStorage()
+}
+
+// finishCompaction completes a committed compaction, moving the staged
+// segments over the originals and removing the segments the marker lists,
+// or discards the staged segments of one that was never committed.
+func (w *WAL) finishCompaction() error {
+	marker := w.prefix + compactMarker
+	removed, err := w.readCompactionMarker(marker)
+	committed := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	names, err := w.storage.List()
+	if err != nil {
+		return err
+	}
+	discarded := false
+	for _, name := range names {
+		target, ok := strings.CutSuffix(name, compactSuffix)
+		if !ok {
+			continue
+		}
+		_, isSegment := w.parseSegmentName(target)
+		if !isSegment && target != marker {
+			continue
+		}
+		if committed && target != marker {
+			err = w.storage.Rename(name, target)
+		} else {
+			err = w.storage.Remove(name)
+			discarded = true
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if !committed {
+		if !discarded {
+			return nil
+		}
+		return w.syncStorage()
+	}
+	for _, name := range removed {
+		err = w.storage.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	err = w.syncStorage()
+	if err != nil {
+		return err
+	}
+	err = w.storage.Remove(marker)
+	if err != nil {
+		return err
+	}
+	return w.syncStorage()
+}
+
+func (w *WAL) readCompactionMarker(marker string) ([]string, error) {
+	file, err := w.storage.Open(marker)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	size, err := file.Size()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	_, err = file.ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(data), "\n"), nil
+}
@@ -0,0 +1,136 @@
+package tinywal
+
+import (
+	"fmt"
+	"testing"
+)
+
+// writeFragmented writes 12 records two to a segment, leaving each segment
+// far below the 88 bytes that fit four.
+func writeFragmented(t *testing.T, w *WAL) {
+	t.Helper()
+	for i := 0; i < 12; i++ {
+		_, err := w.Write([]byte(fmt.Sprintf("r%02d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 1 {
+			err = w.Rotate()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestCompactPreservesRecordsAndOffsets(t *testing.T) {
+	storage := NewMemoryStorage()
+	opts := []Option{WithStorage(storage), WithSegmentSize(88), WithMaxSegments(100)}
+	w := openWAL(t, "", opts...)
+	writeFragmented(t, w)
+	err := w.TruncateBefore(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := recoverAll(t, w)
+	segments := w.Stats().Segments
+	err = w.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := w.Stats().Segments; n >= segments {
+		t.Fatalf("%d segments after compaction, want fewer than %d", n, segments)
+	}
+	if after := recoverAll(t, w); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Fatalf("records = %q, want %q", after, before)
+	}
+	var fromCheckpoint []string
+	err = w.RecoverFrom(6, func(data []byte) error {
+		fromCheckpoint = append(fromCheckpoint, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(fromCheckpoint) != "[r07 r08 r09 r10 r11]" {
+		t.Fatalf("records after checkpoint 6 = %q, want r07 to r11", fromCheckpoint)
+	}
+	data, err := w.Get(9)
+	if err != nil || string(data) != "r09" {
+		t.Fatalf("Get(9) = %q, %v; want r09", data, err)
+	}
+	offset, err := w.Write([]byte("r12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 12 {
+		t.Fatalf("offset = %d, want 12", offset)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, "", opts...)
+	if records := recoverAll(t, w); fmt.Sprint(records) != fmt.Sprint(append(before, "r12")) {
+		t.Fatalf("records after reopen = %q", records)
+	}
+}
+
+func TestCompactInterruptedByCrash(t *testing.T) {
+	for _, committed := range []bool{false, true} {
+		t.Run(fmt.Sprint("committed=", committed), func(t *testing.T) {
+			storage := NewMemoryStorage()
+			opts := []Option{WithStorage(storage), WithSegmentSize(88), WithMaxSegments(100)}
+			w := openWAL(t, "", opts...)
+			writeFragmented(t, w)
+			want := recoverAll(t, w)
+			err := w.Sync()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Stop after staging, or after committing, as a crash would.
+			w.lock.Lock()
+			segmentsWithInfo, err := w.getSortedSegments()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sealed := segmentsWithInfo[:len(segmentsWithInfo)-1]
+			staged, err := w.stageCompaction(sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if committed {
+				var removed []string
+				for _, segmentWithInfo := range sealed[staged:] {
+					removed = append(removed, segmentWithInfo.Name)
+				}
+				err = w.commitCompaction(removed)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			w.lock.Unlock()
+
+			w = openWAL(t, "", opts...)
+			if records := recoverAll(t, w); fmt.Sprint(records) != fmt.Sprint(want) {
+				t.Fatalf("records = %q, want %q", records, want)
+			}
+			segments := len(sealed) + 1
+			if committed {
+				segments = staged + 1
+			}
+			if n := w.Stats().Segments; n != segments {
+				t.Fatalf("%d segments, want %d", n, segments)
+			}
+			names, err := storage.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range names {
+				if _, ok := w.parseSegmentName(name); !ok {
+					t.Fatalf("%s left behind", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package tinywal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// recordCipher seals payloads with AES-GCM. Every record gets a fresh random
+// 12-byte nonce, so nothing has to survive a restart for nonces to stay
+// unique; the chance of a repeat stays negligible up to around 2^32 records
+// per key.
+type recordCipher struct {
+	aead cipher.AEAD
+}
+
+func newRecordCipher(key []byte) (*recordCipher, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &recordCipher{aead: aead}, nil
+}
+
+// seal returns nonce || ciphertext. The record offset is authenticated as
+// additional data so a payload can't be replayed at another offset.
+func (c *recordCipher) seal(offset uint64, data []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, data, offsetBytes(offset)), nil
+}
+
+func (c *recordCipher) open(offset uint64, data []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, ErrDecryption
+	}
+	plain, err := c.aead.Open([]byte{}, data[:nonceSize], data[nonceSize:], offsetBytes(offset))
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return plain, nil
+}
+
+func offsetBytes(offset uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, offset)
+	return buf
+}
@@ -0,0 +1,105 @@
+package tinywal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir, WithEncryption(testKey))
+	_, err := w.Write([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := readSegmentFiles(t, dir)
+	if bytes.Contains(raw, []byte("secret")) {
+		t.Fatal("plaintext found on disk")
+	}
+	w = openWAL(t, dir, WithEncryption(testKey))
+	records := recoverAll(t, w)
+	if len(records) != 1 || records[0] != "secret" {
+		t.Fatalf("records = %q, want [secret]", records)
+	}
+}
+
+func TestEncryptionDetectsTampering(t *testing.T) {
+	dir := t.TempDir()
+	// Without checksums the flipped byte reaches decryption rather than
+	// being caught as ErrChecksumValidation.
+	w := openWAL(t, dir, WithEncryption(testKey), WithChecksum(ChecksumNone))
+	_, err := w.Write([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"))
+	if err != nil || len(names) != 1 {
+		t.Fatalf("segments = %q, %v; want one", names, err)
+	}
+	data, err := os.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	err = os.WriteFile(names[0], data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, dir, WithEncryption(testKey), WithChecksum(ChecksumNone))
+	err = w.Recover(func([]byte) error { return nil })
+	if !errors.Is(err, ErrDecryption) {
+		t.Fatalf("err = %v, want ErrDecryption", err)
+	}
+}
+
+func TestEncryptionNoncesDontRepeatAcrossOpens(t *testing.T) {
+	seen := make(map[string]bool)
+	for open := 0; open < 2; open++ {
+		c, err := newRecordCipher(testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			sealed, err := c.seal(uint64(i), []byte("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonce := string(sealed[:c.aead.NonceSize()])
+			if seen[nonce] {
+				t.Fatalf("nonce repeated at record %d of open %d", i, open)
+			}
+			seen[nonce] = true
+		}
+	}
+}
+
+// readSegmentFiles returns the contents of every segment in dir.
+func readSegmentFiles(t *testing.T, dir string) []byte {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []byte
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, data...)
+	}
+	return all
+}
@@ -20,7 +20,7 @@ func main() {
 	}
 	defer wal.Close()
 	for i := 0; i < 1000000; i++ {
-		err := wal.Write([]byte("SET X 23"))
+		_, err := wal.WriteString("SET X 23")
 		if err != nil {
 			panic(err)
 		}
@@ -28,10 +28,6 @@ func main() {
 	}
 	fmt.Println("Finished Writing")
 
-	err = wal.Sync()
-	if err != nil {
-		panic(err)
-	}
 	count := 0
 	err = wal.Recover(func(data []byte) error {
 		// fmt.Println(string(data))
@@ -0,0 +1,292 @@
+package tinywal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+)
+
+type Record struct {
+	Offset uint64
+	// Length is the length of Data.
+	Length int
+	// Checksum is the checksum of Data alone, using the configured
+	// ChecksumAlgorithm, so it can be checked without knowing the segment
+	// format. ExportJSONL reports the same value. The checksum stored in a
+	// segment also covers the framing and is verified before a record is
+	// delivered. It is zero with ChecksumNone.
+	Checksum uint32
+	Data     []byte
+}
+
+func (w *WAL) newRecord(record rawRecord, data []byte) Record {
+	return Record{
+		Offset:   record.offset,
+		Length:   len(data),
+		Checksum: w.dataChecksum(data),
+		Data:     data,
+	}
+}
+
+// dataChecksum is the checksum Record and ExportJSONL report for a payload.
+func (w *WAL) dataChecksum(data []byte) uint32 {
+	checksums := w.checksum.checksummer()
+	if checksums == nil {
+		return 0
+	}
+	return checksums.checksum(data)
+}
+
+// Follow streams every record with an offset of at least fromOffset, first
+// replaying what is already in the log and then delivering new records as
+// they are written. The channel is closed when ctx is done or the WAL is
+// closed. A slow consumer only holds back its own follower, never writers.
+// A follower keeps its place between records and reads the ones the writer
+// still buffers without flushing them.
+func (w *WAL) Follow(ctx context.Context, fromOffset uint64) (<-chan Record, error) {
+	records := make(chan Record)
+	go w.follow(ctx, fromOffset, records)
+	return records, nil
+}
+
+func (w *WAL) follow(ctx context.Context, next uint64, records chan<- Record) {
+	defer close(records)
+	f := &follower{w: w, next: next}
+	for {
+		notify := w.writeNotifier()
+		err := f.catchUp(func(record Record) error {
+			select {
+			case records <- record:
+				return nil
+			case <-ctx.Done():
+				return ErrStopRecovery
+			}
+		})
+		if err == ErrStopRecovery {
+			return
+		}
+		if err != nil {
+			if err != ErrWALClosed {
+				w.logger.Error("follow failed", "offset", f.next, "error", err)
+			}
+			return
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// follower is how far Follow has read: the segment it is in and a decoder
+// positioned after the last record it looked at, so each pass only decodes
+// the records written since the one before.
+type follower struct {
+	w       *WAL
+	next    uint64
+	segment *segmentInfo
+	decoder *segmentDecoder
+}
+
+// catchUp delivers every record from next on that has been written so far.
+func (f *follower) catchUp(deliver func(Record) error) error {
+	if f.segment == nil {
+		segmentsWithInfo, err := f.w.listSegments()
+		if err != nil || len(segmentsWithInfo) == 0 {
+			return err
+		}
+		first, err := f.w.segmentFor(segmentsWithInfo, f.next)
+		if err != nil {
+			return err
+		}
+		f.segment = segmentsWithInfo[first]
+	}
+	for {
+		sealed, err := f.readSegment(deliver)
+		if err != nil || !sealed {
+			return err
+		}
+		found, err := f.advance()
+		if err != nil || !found {
+			return err
+		}
+	}
+}
+
+// advance moves on to the segment after the sealed one just read, reporting
+// whether there is one yet.
+func (f *follower) advance() (bool, error) {
+	segmentsWithInfo, err := f.w.listSegments()
+	if err != nil {
+		return false, err
+	}
+	for _, segmentWithInfo := range segmentsWithInfo {
+		if segmentWithInfo.Index > f.segment.Index {
+			f.segment = segmentWithInfo
+			f.decoder = nil
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readSegment delivers the records of the follower's segment that it hasn't
+// read yet and reports whether the segment is sealed, so that nothing more
+// will be appended to it. A segment removed in the meantime counts as sealed.
+func (f *follower) readSegment(deliver func(Record) error) (bool, error) {
+	var from int64
+	if f.decoder != nil {
+		from = f.decoder.pos
+	}
+	view, err := f.w.viewSegment(f.segment.Index, from)
+	if err != nil {
+		return false, err
+	}
+	file, err := f.w.storage.Open(f.segment.Name)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	var source *io.SectionReader
+	if view.sealed {
+		size, err := file.Size()
+		if err != nil {
+			return false, err
+		}
+		source = io.NewSectionReader(file, 0, size)
+	} else {
+		segment := bufferedSegment{file: file, tail: view.tail, tailStart: view.tailStart}
+		source = io.NewSectionReader(segment, 0, view.limit)
+	}
+	if f.decoder == nil {
+		decoder, err := newSegmentDecoder(source)
+		if err != nil {
+			return false, err
+		}
+		if f.segment.start > decoder.pos {
+			err = decoder.seek(f.segment.start)
+			if err != nil {
+				return false, err
+			}
+		}
+		f.decoder = decoder
+	} else {
+		err = f.decoder.reopen(source)
+		if err != nil {
+			return false, err
+		}
+	}
+	var scan segmentScan
+	err = f.w.scanRecords(f.segment.Name, f.decoder, f.w.recoveryMode, &scan, func(record rawRecord) error {
+		if record.offset < f.next {
+			return nil
+		}
+		data, err := f.w.payload.decode(record)
+		if err != nil {
+			return err
+		}
+		err = deliver(f.w.newRecord(record, append([]byte{}, data...)))
+		if err != nil {
+			return err
+		}
+		f.next = record.offset + 1
+		return nil
+	})
+	return view.sealed, err
+}
+
+// segmentView is what a follower may read of a segment. For the active
+// segment that is its acknowledged records, the ones from tailStart on
+// copied out of the writer's buffer into tail.
+type segmentView struct {
+	sealed    bool
+	limit     int64
+	tail      []byte
+	tailStart int64
+}
+
+// viewSegment describes the segment with the given index for a follower
+// that has read it up to from.
+func (w *WAL) viewSegment(index uint64, from int64) (segmentView, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return segmentView{}, ErrWALClosed
+	}
+	if w.readOnly || index != w.segmentIndex {
+		return segmentView{sealed: true}, nil
+	}
+	view := segmentView{limit: w.ackedSize, tailStart: w.ackedSize}
+	written := w.bufWriter.written
+	if written < w.ackedSize {
+		view.tailStart = max(from, written)
+		view.tail = w.bufWriter.copyRange(view.tailStart, w.ackedSize)
+	}
+	return view, nil
+}
+
+// listSegments lists the segments without flushing the active one.
+func (w *WAL) listSegments() ([]*segmentInfo, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return nil, ErrWALClosed
+	}
+	return w.getSortedSegments()
+}
+
+// bufferedSegment reads a segment from file, except for the bytes from
+// tailStart on, which are read from tail.
+type bufferedSegment struct {
+	file      io.ReaderAt
+	tail      []byte
+	tailStart int64
+}
+
+func (s bufferedSegment) ReadAt(p []byte, off int64) (int, error) {
+	if off >= s.tailStart {
+		if off-s.tailStart >= int64(len(s.tail)) {
+			return 0, io.EOF
+		}
+		n := copy(p, s.tail[off-s.tailStart:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	head := p
+	if off+int64(len(p)) > s.tailStart {
+		head = p[:s.tailStart-off]
+	}
+	n, err := s.file.ReadAt(head, off)
+	if n < len(head) || len(head) == len(p) {
+		return n, err
+	}
+	m, err := s.ReadAt(p[n:], s.tailStart)
+	return n + m, err
+}
+
+// writeNotifier returns a channel that is closed by the next write.
+func (w *WAL) writeNotifier() <-chan struct{} {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.writeNotify == nil {
+		w.writeNotify = make(chan struct{})
+	}
+	return w.writeNotify
+}
+
+func (w *WAL) notifyFollowers() {
+	if w.writeNotify == nil {
+		return
+	}
+	close(w.writeNotify)
+	w.writeNotify = nil
+}
@@ -0,0 +1,111 @@
+package tinywal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// nextRecord waits for the follower to deliver a record.
+func nextRecord(t *testing.T, records <-chan Record) Record {
+	t.Helper()
+	select {
+	case record, ok := <-records:
+		if !ok {
+			t.Fatal("follower closed early")
+		}
+		return record
+	case <-time.After(time.Second):
+		t.Fatal("follower delivered nothing")
+	}
+	return Record{}
+}
+
+func TestFollowReplaysThenStreams(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(100))
+	writeNumbered(t, w, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	records, err := w.Follow(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := 1; want < 10; want++ {
+		if want == 3 {
+			go func() {
+				for i := 3; i < 10; i++ {
+					w.Write([]byte(fmt.Sprint(i)))
+				}
+			}()
+		}
+		record := nextRecord(t, records)
+		if record.Offset != uint64(want) || string(record.Data) != fmt.Sprint(want) {
+			t.Fatalf("got offset %d %q, want %d", record.Offset, record.Data, want)
+		}
+	}
+	cancel()
+	select {
+	case _, ok := <-records:
+		if ok {
+			t.Fatal("follower delivered a record after cancellation")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("follower didn't close after cancellation")
+	}
+}
+
+func TestFollowReadsBufferedRecords(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSyncMode(SyncNever), WithBufferSize(1<<16))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	records, err := w.Follow(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		_, err := w.Write([]byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := nextRecord(t, records)
+		if record.Offset != uint64(i) || string(record.Data) != fmt.Sprint(i) {
+			t.Fatalf("got offset %d %q, want %d", record.Offset, record.Data, i)
+		}
+	}
+	file, err := w.storage.Open(w.CurrentSegment())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	size, err := file.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 0 {
+		t.Fatalf("following flushed %d bytes", size)
+	}
+}
+
+func BenchmarkFollow(b *testing.B) {
+	w, err := NewWithOptions(b.TempDir(), WithSegmentSize(64<<20), WithSyncMode(SyncNever))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	records, err := w.Follow(ctx, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := make([]byte, 128)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := w.Write(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		<-records
+	}
+}
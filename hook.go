@@ -0,0 +1,85 @@
+package tinywal
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// rotateHook hands sealed segments to a user callback on its own goroutine,
+// so a slow or failing callback never holds up writers.
+type rotateHook struct {
+	callback func(SegmentMeta) error
+	logger   *slog.Logger
+	lock     sync.Mutex
+	pending  []SegmentMeta
+	wake     chan struct{}
+}
+
+func newRotateHook(callback func(SegmentMeta) error, logger *slog.Logger) *rotateHook {
+	if callback == nil {
+		return nil
+	}
+	return &rotateHook{
+		callback: callback,
+		logger:   logger,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// enqueue schedules a sealed segment for the callback without blocking.
+func (h *rotateHook) enqueue(meta SegmentMeta) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	h.pending = append(h.pending, meta)
+	h.lock.Unlock()
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers sealed segments in order until done is closed, then delivers
+// whatever is still queued.
+func (h *rotateHook) run(done <-chan struct{}, report func(error)) {
+	for {
+		select {
+		case <-h.wake:
+			h.deliver(report)
+		case <-done:
+			h.deliver(report)
+			return
+		}
+	}
+}
+
+func (h *rotateHook) deliver(report func(error)) {
+	h.lock.Lock()
+	pending := h.pending
+	h.pending = nil
+	h.lock.Unlock()
+	for _, meta := range pending {
+		err := h.callback(meta)
+		if err != nil {
+			h.logger.Error("rotate callback failed", "segment", meta.Name, "error", err)
+			report(err)
+		}
+	}
+}
+
+// sealedSegment describes the active segment as it is being rotated out.
+func (w *WAL) sealedSegment() SegmentMeta {
+	meta := SegmentMeta{
+		Name:      w.currentName,
+		Index:     w.segmentIndex,
+		Records:   w.segmentRecords,
+		Size:      w.currentSize,
+		CreatedAt: w.segmentCreated,
+	}
+	if w.segmentRecords > 0 {
+		meta.FirstOffset = w.segmentFirst
+		meta.LastOffset = w.currentOffset - 1
+	}
+	return meta
+}
@@ -0,0 +1,53 @@
+package tinywal
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOnRotateReceivesSealedSegment(t *testing.T) {
+	sealed := make(chan SegmentMeta, 10)
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(88),
+		WithOnRotate(func(meta SegmentMeta) error {
+			sealed <- meta
+			return nil
+		}))
+	first := w.CurrentSegment()
+	writeNumbered(t, w, 5)
+	select {
+	case meta := <-sealed:
+		if meta.Name != first || meta.Index != 1 || meta.FirstOffset != 0 || meta.LastOffset != 3 || meta.Records != 4 {
+			t.Fatalf("sealed segment = %+v, want %s holding offsets 0 to 3", meta, first)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnRotate wasn't called")
+	}
+}
+
+func TestOnRotateErrorsDontBlockWrites(t *testing.T) {
+	failure := errors.New("upload failed")
+	syncErrors := make(chan error, 10)
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSyncErrors(syncErrors),
+		WithOnRotate(func(SegmentMeta) error {
+			return failure
+		}))
+	for i := 0; i < 3; i++ {
+		err := w.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := w.Write([]byte("still writing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-syncErrors:
+		if err != failure {
+			t.Fatalf("reported %v, want the callback's error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback error wasn't reported")
+	}
+}
@@ -0,0 +1,136 @@
+package tinywal
+
+import "sort"
+
+// offsetIndex is a sparse in-memory map from offsets to the position of
+// their framing, holding one entry per interval records of each segment so
+// seeks only scan at most interval records.
+type offsetIndex struct {
+	interval uint64
+	segments []indexedSegment
+}
+
+type indexedSegment struct {
+	index   uint64
+	entries []indexEntry
+}
+
+type indexEntry struct {
+	offset   uint64
+	position int64
+}
+
+// newOffsetIndex returns nil, a valid empty index, when interval isn't
+// positive.
+func newOffsetIndex(interval int) *offsetIndex {
+	if interval <= 0 {
+		return nil
+	}
+	return &offsetIndex{interval: uint64(interval)}
+}
+
+// add records the position of a record. Records must be added in offset
+// order.
+func (x *offsetIndex) add(segment uint64, offset uint64, position int64) {
+	if x == nil {
+		return
+	}
+	n := len(x.segments)
+	if n == 0 || x.segments[n-1].index != segment {
+		x.segments = append(x.segments, indexedSegment{index: segment})
+		n += 1
+	}
+	indexed := &x.segments[n-1]
+	last := len(indexed.entries) - 1
+	if last >= 0 && offset < indexed.entries[last].offset+x.interval {
+		return
+	}
+	indexed.entries = append(indexed.entries, indexEntry{offset: offset, position: position})
+}
+
+// lookup returns the closest indexed position at or before offset.
+func (x *offsetIndex) lookup(offset uint64) (uint64, int64, bool) {
+	if x == nil {
+		return 0, 0, false
+	}
+	i := sort.Search(len(x.segments), func(i int) bool {
+		return x.segments[i].entries[0].offset > offset
+	}) - 1
+	if i < 0 {
+		return 0, 0, false
+	}
+	entries := x.segments[i].entries
+	j := sort.Search(len(entries), func(j int) bool {
+		return entries[j].offset > offset
+	}) - 1
+	return x.segments[i].index, entries[j].position, true
+}
+
+// drop forgets a segment that has been deleted.
+func (x *offsetIndex) drop(segment uint64) {
+	if x == nil {
+		return
+	}
+	for i, indexed := range x.segments {
+		if indexed.index == segment {
+			x.segments = append(x.segments[:i], x.segments[i+1:]...)
+			return
+		}
+	}
+}
+
+// truncate forgets the entries of segment from offset onwards, for records
+// that were rolled back.
+func (x *offsetIndex) truncate(segment uint64, offset uint64) {
+	if x == nil {
+		return
+	}
+	n := len(x.segments)
+	if n == 0 || x.segments[n-1].index != segment {
+		return
+	}
+	indexed := &x.segments[n-1]
+	i := sort.Search(len(indexed.entries), func(i int) bool {
+		return indexed.entries[i].offset >= offset
+	})
+	indexed.entries = indexed.entries[:i]
+	if i == 0 {
+		x.segments = x.segments[:n-1]
+	}
+}
+
+func (x *offsetIndex) reset() {
+	if x == nil {
+		return
+	}
+	x.segments = nil
+}
+
+// buildIndex indexes every segment on disk.
+func (w *WAL) buildIndex() error {
+	if w.index == nil {
+		return nil
+	}
+	segmentsWithInfo, err := w.getSortedSegments()
+	if err != nil {
+		return err
+	}
+	for _, segmentWithInfo := range segmentsWithInfo {
+		_, err = w.scanSegment(segmentWithInfo, w.recoveryMode, func(record rawRecord) error {
+			w.index.add(segmentWithInfo.Index, record.offset, record.position)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupIndex returns the indexed segment and position to start scanning
+// from to reach offset.
+func (w *WAL) lookupIndex(offset uint64) (uint64, int64, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.index.lookup(offset)
+}
@@ -0,0 +1,79 @@
+package tinywal
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestOffsetIndexLookup(t *testing.T) {
+	index := newOffsetIndex(4)
+	for offset := uint64(0); offset < 10; offset++ {
+		index.add(1, offset, int64(offset*100))
+	}
+	for offset := uint64(10); offset < 20; offset++ {
+		index.add(2, offset, int64(offset*100))
+	}
+	for _, test := range []struct {
+		offset   uint64
+		segment  uint64
+		position int64
+	}{
+		{0, 1, 0},
+		{5, 1, 400},
+		{9, 1, 800},
+		{10, 2, 1000},
+		{19, 2, 1800},
+	} {
+		segment, position, ok := index.lookup(test.offset)
+		if !ok || segment != test.segment || position != test.position {
+			t.Fatalf("lookup(%d) = %d, %d, %t; want %d, %d", test.offset, segment, position, ok, test.segment, test.position)
+		}
+	}
+}
+
+func TestIndexedGetMatchesScan(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir, WithSegmentSize(1024), WithMaxSegments(100), WithIndexInterval(8))
+	writeNumbered(t, w, 200)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reopening rebuilds the index from disk.
+	w = openWAL(t, dir, WithSegmentSize(1024), WithIndexInterval(8))
+	for offset := uint64(0); offset < 200; offset += 7 {
+		data, err := w.Get(offset)
+		if err != nil {
+			t.Fatalf("Get(%d): %v", offset, err)
+		}
+		if string(data) != fmt.Sprint(offset) {
+			t.Fatalf("Get(%d) = %q", offset, data)
+		}
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, interval := range []int{0, 64} {
+		b.Run(fmt.Sprintf("interval=%d", interval), func(b *testing.B) {
+			w, err := NewWithOptions("", WithStorage(NewMemoryStorage()), WithIndexInterval(interval))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer w.Close()
+			const records = 100000
+			for i := 0; i < records; i++ {
+				_, err := w.Write([]byte("SET X 23"))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := w.Get(uint64(i*7919) % records)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package tinywal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errLengthMismatch = errors.New("payload length does not match length")
+
+// jsonRecord is the JSON lines form of a record. The payload is base64
+// encoded, as encoding/json does for byte slices, and the checksum is that
+// of the payload, as in Record.
+type jsonRecord struct {
+	Offset   uint64 `json:"offset"`
+	Type     uint16 `json:"type,omitempty"`
+	Checksum uint32 `json:"checksum"`
+	Length   int    `json:"length"`
+	Payload  []byte `json:"payload"`
+}
+
+// ExportJSONL writes every valid record, oldest first, to out as one JSON
+// object per line with its offset, type, checksum, payload length and
+// payload. Payloads are written decompressed and decrypted, and the checksum
+// is that of the payload using the configured ChecksumAlgorithm, like
+// Record.Checksum, not the one stored in the record's framing.
+func (w *WAL) ExportJSONL(out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	_, err := w.recoverRecords(nil, func(record rawRecord) error {
+		return encoder.Encode(jsonRecord{
+			Offset:   record.offset,
+			Type:     record.recordType,
+			Checksum: w.dataChecksum(record.data),
+			Length:   len(record.data),
+			Payload:  record.data,
+		})
+	})
+	return err
+}
+
+// ImportJSONL appends the records of a dump written by ExportJSONL, rotating
+// as needed. With preserveOffsets, each record keeps its offset, which must
+// be the next offset, except that the first record imported into a WAL
+// holding no records may start anywhere; otherwise the import fails with
+// ErrImportOffset. Without it records are given the next offsets in turn.
+// Writers wait until the import finishes. A malformed line stops the import
+// with an error naming it, leaving the records before it appended, synced
+// under SyncAlways and delivered to followers.
+func (w *WAL) ImportJSONL(r io.Reader, preserveOffsets bool) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	imported, err := w.importLines(r, preserveOffsets)
+	if imported == 0 {
+		return err
+	}
+	w.notifyFollowers()
+	syncErr := w.syncIfAlways()
+	if err != nil {
+		return err
+	}
+	return syncErr
+}
+
+// importLines imports every line of r and returns how many records it
+// appended, including when a line fails.
+func (w *WAL) importLines(r io.Reader, preserveOffsets bool) (int, error) {
+	reader := bufio.NewReader(r)
+	imported := 0
+	for line := 1; ; line++ {
+		text, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return imported, err
+		}
+		if len(bytes.TrimSpace(text)) > 0 {
+			err := w.importRecord(text, preserveOffsets)
+			if err != nil {
+				return imported, fmt.Errorf("line %d: %w", line, err)
+			}
+			imported += 1
+		}
+		if err == io.EOF {
+			return imported, nil
+		}
+	}
+}
+
+func (w *WAL) importRecord(text []byte, preserveOffsets bool) error {
+	var record jsonRecord
+	err := json.Unmarshal(text, &record)
+	if err != nil {
+		return err
+	}
+	if record.Length != len(record.Payload) {
+		return errLengthMismatch
+	}
+	offset := w.currentOffset
+	if preserveOffsets && record.Offset != offset {
+		// Offsets stay contiguous, which RecordCount relies on, so they
+		// may only skip ahead while there are no records to skip from.
+		err = w.writable()
+		if err != nil {
+			return err
+		}
+		empty, err := w.empty()
+		if err != nil {
+			return err
+		}
+		if record.Offset < offset || !empty {
+			return ErrImportOffset
+		}
+		offset = record.Offset
+	}
+	_, err = w.writeRecordAt(offset, record.Type, record.Payload)
+	if err != nil {
+		return err
+	}
+	// Records before a failing line stay appended.
+	w.acknowledge()
+	return nil
+}
+
+// empty reports whether no segment holds a record.
+func (w *WAL) empty() (bool, error) {
+	err := w.flush()
+	if err != nil {
+		return false, err
+	}
+	segmentsWithInfo, err := w.getSortedSegments()
+	if err != nil {
+		return false, err
+	}
+	_, ok, err := w.firstOffsetOf(segmentsWithInfo)
+	return !ok, err
+}
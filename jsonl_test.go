@@ -0,0 +1,235 @@
+package tinywal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportJSONL(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(100))
+	want := []typedRecord{{0, "SET a"}, {2, "DELETE a"}, {0, "\x00binary\xff"}, {0, ""}}
+	for _, record := range want {
+		_, err := w.WriteTyped(record.recordType, []byte(record.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out bytes.Buffer
+	err := w.ExportJSONL(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(out.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != len(want) {
+		t.Fatalf("%d lines, want %d", len(lines), len(want))
+	}
+	for i, line := range lines {
+		var record jsonRecord
+		err := json.Unmarshal(line, &record)
+		if err != nil {
+			t.Fatalf("line %d: %v", i+1, err)
+		}
+		if record.Offset != uint64(i) || record.Type != want[i].recordType ||
+			string(record.Payload) != want[i].data || record.Length != len(want[i].data) {
+			t.Fatalf("line %d = %+v, want offset %d and %+v", i+1, record, i, want[i])
+		}
+		if record.Checksum != crc32.ChecksumIEEE(record.Payload) {
+			t.Fatalf("line %d checksum = %x, want the payload's CRC-32", i+1, record.Checksum)
+		}
+	}
+}
+
+func TestExportJSONLFieldNames(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()))
+	_, err := w.Write([]byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = w.ExportJSONL(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	err = json.Unmarshal(out.Bytes(), &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Untyped records leave the type out, and payloads are base64.
+	if got := fmt.Sprintf("%v %v %v %v", fields["offset"], fields["length"], fields["payload"], fields["type"]); got != "0 2 aGk= <nil>" {
+		t.Fatalf("fields = %v", fields)
+	}
+}
+
+// exportLines exports w and returns the dump.
+func exportLines(t *testing.T, w *WAL) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	err := w.ExportJSONL(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestImportJSONLRoundTrip(t *testing.T) {
+	sealed := make(chan SegmentMeta, 100)
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(88), WithMaxSegments(100),
+		WithOnRotate(func(meta SegmentMeta) error {
+			sealed <- meta
+			return nil
+		}))
+	writeNumbered(t, w, 10)
+	// The dump then starts at offset 4, as one taken after truncation would.
+	err := w.TruncateBefore(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := exportLines(t, w)
+	err = w.Purge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := w.CurrentSegment()
+	err = w.ImportJSONL(bytes.NewReader(dump), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := exportLines(t, w); !bytes.Equal(got, dump) {
+		t.Fatalf("exported after import:\n%s\nwant:\n%s", got, dump)
+	}
+	count, err := w.RecordCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 6 {
+		t.Fatalf("RecordCount = %d, want 6", count)
+	}
+	offset, err := w.Write([]byte("10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 10 {
+		t.Fatalf("offset after import = %d, want 10", offset)
+	}
+	for {
+		select {
+		case meta := <-sealed:
+			if meta.Name != first {
+				continue
+			}
+			if meta.FirstOffset != 4 || meta.LastOffset != 7 {
+				t.Fatalf("sealed segment = %+v, want offsets 4 to 7", meta)
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatal("the first imported segment was never sealed")
+		}
+	}
+}
+
+func TestImportJSONLRejectsOffsetGaps(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()))
+	dump := `{"offset":0,"checksum":0,"length":1,"payload":"YQ=="}
+{"offset":100,"checksum":0,"length":1,"payload":"Yg=="}
+`
+	err := w.ImportJSONL(strings.NewReader(dump), true)
+	if !errors.Is(err, ErrImportOffset) || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("err = %v, want ErrImportOffset on line 2", err)
+	}
+	count, err := w.RecordCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("RecordCount = %d, want 1", count)
+	}
+	err = w.ImportJSONL(strings.NewReader(`{"offset":0,"checksum":0,"length":1,"payload":"YQ=="}`), true)
+	if !errors.Is(err, ErrImportOffset) {
+		t.Fatalf("err = %v, want ErrImportOffset for a repeated offset", err)
+	}
+}
+
+func TestImportJSONLFailedWriteKeepsOffset(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithMaxRecordSize(4))
+	err := w.ImportJSONL(strings.NewReader(`{"offset":100,"checksum":0,"length":6,"payload":"dG9vYmln"}`), true)
+	if !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("err = %v, want ErrRecordTooLarge", err)
+	}
+	offset, err := w.Write([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 0 {
+		t.Fatalf("offset = %d, want 0 after the failed import", offset)
+	}
+}
+
+func TestImportJSONLReassignsOffsets(t *testing.T) {
+	source := openWAL(t, "", WithStorage(NewMemoryStorage()))
+	writeNumbered(t, source, 3)
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()))
+	writeNumbered(t, w, 2)
+	err := w.ImportJSONL(bytes.NewReader(exportLines(t, source)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	err = w.RecoverDetailed(func(record Record) error {
+		got = append(got, fmt.Sprintf("%d:%s", record.Offset, record.Data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[0:0 1:1 2:0 3:1 4:2]" {
+		t.Fatalf("records = %v", got)
+	}
+}
+
+func TestImportJSONLNamesMalformedLine(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()))
+	dump := `{"offset":0,"checksum":0,"length":1,"payload":"YQ=="}
+
+{"offset":1,"checksum":0,"length":2,"payload":"Yg=="}
+`
+	err := w.ImportJSONL(strings.NewReader(dump), true)
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("err = %v, want an error naming line 3", err)
+	}
+	if records := recoverAll(t, w); fmt.Sprint(records) != "[a]" {
+		t.Fatalf("records = %q, want the line before the error", records)
+	}
+}
+
+func TestImportJSONLFailureStillSyncsAndNotifies(t *testing.T) {
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithSyncMode(SyncAlways))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	records, err := w.Follow(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncs := storage.fileSyncs()
+	dump := `{"offset":0,"checksum":0,"length":1,"payload":"YQ=="}
+not json
+`
+	err = w.ImportJSONL(strings.NewReader(dump), true)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("err = %v, want an error naming line 2", err)
+	}
+	if storage.fileSyncs() == syncs {
+		t.Fatal("the appended record wasn't synced")
+	}
+	if record := nextRecord(t, records); record.Offset != 0 || string(record.Data) != "a" {
+		t.Fatalf("follower got offset %d %q, want 0 a", record.Offset, record.Data)
+	}
+}
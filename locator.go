@@ -0,0 +1,128 @@
+package tinywal
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Locator pins a record to where it is stored: its offset, the index of the
+// segment holding it and the byte position its framing starts at within
+// that segment. Locators stay valid until the segment is pruned.
+type Locator struct {
+	Offset   uint64
+	Segment  uint64
+	Position int64
+}
+
+// WriteLocated appends data like Write and returns the new record's locator,
+// which ReadAt can later use to fetch it without scanning the segment.
+func (w *WAL) WriteLocated(data []byte) (Locator, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	locator, err := w.writeRecord(0, data)
+	if err != nil {
+		return Locator{}, err
+	}
+	err = w.commit(w.syncIfAlways)
+	if err != nil {
+		return Locator{}, err
+	}
+	return locator, nil
+}
+
+// ReadAt returns the payload of the record at locator. It returns
+// ErrSegmentNotFound if the segment no longer exists, and
+// ErrChecksumValidation or ErrBytesLength if the position doesn't hold the
+// record the locator describes.
+func (w *WAL) ReadAt(locator Locator) ([]byte, error) {
+	segmentsWithInfo, err := w.snapshotSegments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segmentWithInfo := range segmentsWithInfo {
+		if segmentWithInfo.Index != locator.Segment {
+			continue
+		}
+		record, err := w.readRecordAt(segmentWithInfo, locator.Position)
+		if err != nil {
+			return nil, err
+		}
+		if record.offset != locator.Offset {
+			return nil, ErrChecksumValidation
+		}
+		data, err := w.payload.decode(record)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, data...), nil
+	}
+	return nil, ErrSegmentNotFound
+}
+
+// readRecordAt decodes the single record framed at position. The returned
+// data is only valid until the next read of the segment.
+func (w *WAL) readRecordAt(segmentWithInfo *segmentInfo, position int64) (rawRecord, error) {
+	segment, decoder, err := openSegment(w.storage, segmentWithInfo)
+	if errors.Is(err, os.ErrNotExist) {
+		return rawRecord{}, ErrSegmentNotFound
+	}
+	if err != nil {
+		return rawRecord{}, err
+	}
+	defer segment.Close()
+	if position < decoder.pos {
+		return rawRecord{}, ErrBytesLength
+	}
+	err = decoder.seek(position)
+	if err != nil {
+		return rawRecord{}, err
+	}
+	record, err := decoder.next()
+	if err == io.EOF {
+		return rawRecord{}, ErrBytesLength
+	}
+	return record, err
+}
+
+// Get returns the payload of the record at offset, scanning only from the
+// segment that holds it. It returns ErrRecordNotFound if offset hasn't been
+// written yet or its record was pruned, truncated or lost to corruption.
+func (w *WAL) Get(offset uint64) ([]byte, error) {
+	segmentsWithInfo, err := w.snapshotSegments()
+	if err != nil {
+		return nil, err
+	}
+	first, err := w.segmentFor(segmentsWithInfo, offset)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	found := false
+	for _, segmentWithInfo := range segmentsWithInfo[first:] {
+		_, err = w.scanSegment(segmentWithInfo, w.recoveryMode, func(record rawRecord) error {
+			if record.offset < offset {
+				return nil
+			}
+			if record.offset == offset {
+				payload, err := w.payload.decode(record)
+				if err != nil {
+					return err
+				}
+				data = append([]byte{}, payload...)
+				found = true
+			}
+			return errStopSegment
+		})
+		if err == errStopSegment {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, ErrRecordNotFound
+	}
+	return data, nil
+}
@@ -0,0 +1,70 @@
+package tinywal
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestWriteLocatedThenReadAt(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(100))
+	var locators []Locator
+	for i := 0; i < 10; i++ {
+		locator, err := w.WriteLocated([]byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locator.Offset != uint64(i) {
+			t.Fatalf("locator offset = %d, want %d", locator.Offset, i)
+		}
+		locators = append(locators, locator)
+	}
+	if locators[0].Segment == locators[9].Segment {
+		t.Fatal("records didn't span several segments")
+	}
+	for i, locator := range locators {
+		data, err := w.ReadAt(locator)
+		if err != nil {
+			t.Fatalf("ReadAt(%+v): %v", locator, err)
+		}
+		if string(data) != fmt.Sprint(i) {
+			t.Fatalf("ReadAt(%+v) = %q, want %d", locator, data, i)
+		}
+	}
+	stale := locators[3]
+	stale.Offset = 4
+	_, err := w.ReadAt(stale)
+	if !errors.Is(err, ErrChecksumValidation) {
+		t.Fatalf("mismatched locator err = %v, want ErrChecksumValidation", err)
+	}
+	_, err = w.ReadAt(Locator{Segment: 1000})
+	if !errors.Is(err, ErrSegmentNotFound) {
+		t.Fatalf("missing segment err = %v, want ErrSegmentNotFound", err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(100))
+	writeNumbered(t, w, 20)
+	for _, offset := range []uint64{0, 9, 19} {
+		data, err := w.Get(offset)
+		if err != nil {
+			t.Fatalf("Get(%d): %v", offset, err)
+		}
+		if string(data) != fmt.Sprint(offset) {
+			t.Fatalf("Get(%d) = %q", offset, data)
+		}
+	}
+	_, err := w.Get(20)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Fatalf("Get past the end err = %v, want ErrRecordNotFound", err)
+	}
+	err = w.TruncateBefore(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Get(0)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Fatalf("Get of a truncated record err = %v, want ErrRecordNotFound", err)
+	}
+}
@@ -0,0 +1,15 @@
+package tinywal
+
+import (
+	"context"
+	"log/slog"
+)
+
+// discardHandler drops every record, so the WAL stays silent unless a
+// Logger is configured.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
@@ -0,0 +1,198 @@
+package tinywal
+
+import (
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	defaultSegmentSize    = 64 * 1024 * 1024
+	defaultMaxSegments    = 10
+	defaultSyncTimePeriod = 500 * time.Millisecond
+)
+
+type Option func(*Config)
+
+func WithSegmentSize(size int64) Option {
+	return func(c *Config) {
+		c.SegmentSize = size
+	}
+}
+
+func WithMaxSegments(count int) Option {
+	return func(c *Config) {
+		c.MaxSegments = count
+	}
+}
+
+func WithMaxTotalBytes(size int64) Option {
+	return func(c *Config) {
+		c.MaxTotalBytes = size
+	}
+}
+
+func WithNoRetention(enabled bool) Option {
+	return func(c *Config) {
+		c.NoRetention = enabled
+	}
+}
+
+func WithSyncPeriod(period time.Duration) Option {
+	return func(c *Config) {
+		c.SyncTimePeriod = period
+	}
+}
+
+func WithSyncMode(mode SyncMode) Option {
+	return func(c *Config) {
+		c.SyncMode = mode
+	}
+}
+
+func WithSyncErrors(errors chan<- error) Option {
+	return func(c *Config) {
+		c.SyncErrors = errors
+	}
+}
+
+func WithFsync(enabled bool) Option {
+	return func(c *Config) {
+		c.DisableFsync = !enabled
+	}
+}
+
+func WithTruncateTornTail(enabled bool) Option {
+	return func(c *Config) {
+		c.TruncateTornTail = enabled
+	}
+}
+
+func WithAllowRepair(enabled bool) Option {
+	return func(c *Config) {
+		c.AllowRepair = enabled
+	}
+}
+
+func WithRecoveryMode(mode RecoveryMode) Option {
+	return func(c *Config) {
+		c.RecoveryMode = mode
+	}
+}
+
+func WithChecksum(algorithm ChecksumAlgorithm) Option {
+	return func(c *Config) {
+		c.Checksum = algorithm
+	}
+}
+
+func WithCompression(codec Codec) Option {
+	return func(c *Config) {
+		c.Compression = codec
+	}
+}
+
+func WithEncryption(key []byte) Option {
+	return func(c *Config) {
+		c.EncryptionKey = key
+	}
+}
+
+func WithMaxRecordSize(size int64) Option {
+	return func(c *Config) {
+		c.MaxRecordSize = size
+	}
+}
+
+func WithIndexInterval(interval int) Option {
+	return func(c *Config) {
+		c.IndexInterval = interval
+	}
+}
+
+func WithClock(clock Clock) Option {
+	return func(c *Config) {
+		c.Clock = clock
+	}
+}
+
+func WithStorage(storage Storage) Option {
+	return func(c *Config) {
+		c.Storage = storage
+	}
+}
+
+func WithMaxSegmentAge(age time.Duration) Option {
+	return func(c *Config) {
+		c.MaxSegmentAge = age
+	}
+}
+
+func WithOnRotate(callback func(sealed SegmentMeta) error) Option {
+	return func(c *Config) {
+		c.OnRotate = callback
+	}
+}
+
+func WithFileMode(mode os.FileMode) Option {
+	return func(c *Config) {
+		c.FileMode = mode
+	}
+}
+
+func WithDirMode(mode os.FileMode) Option {
+	return func(c *Config) {
+		c.DirMode = mode
+	}
+}
+
+func WithPrefix(prefix string) Option {
+	return func(c *Config) {
+		c.Prefix = prefix
+	}
+}
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
+
+func WithBufferSize(size int) Option {
+	return func(c *Config) {
+		c.BufferSize = size
+	}
+}
+
+func WithPreallocate(enabled bool) Option {
+	return func(c *Config) {
+		c.Preallocate = enabled
+	}
+}
+
+func NewWithOptions(logDir string, opts ...Option) (*WAL, error) {
+	return New(newConfig(logDir, opts))
+}
+
+// OpenReadOnly opens the existing segments in logDir for reading. It never
+// creates, truncates or removes files, unless AllowRepair lets
+// RepairSegment do so, and runs no background goroutines;
+// Write, Rotate, Sync and the truncation methods return ErrReadOnly. Each
+// read lists the segments afresh, so records appended by a writer in another
+// process are picked up.
+func OpenReadOnly(logDir string, opts ...Option) (*WAL, error) {
+	return open(newConfig(logDir, opts), true)
+}
+
+func newConfig(logDir string, opts []Option) *Config {
+	config := &Config{
+		LogDir:         logDir,
+		SegmentSize:    defaultSegmentSize,
+		MaxSegments:    defaultMaxSegments,
+		SyncTimePeriod: defaultSyncTimePeriod,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return config
+}
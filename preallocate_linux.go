@@ -0,0 +1,26 @@
+package tinywal
+
+import (
+	"errors"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, which reserves blocks without
+// growing the file, so appends still land right after the last record and
+// no zero padding is ever read back.
+const fallocKeepSize = 0x1
+
+// preallocate reserves size bytes of disk for file. Files without a
+// descriptor, such as those of a custom Storage, and filesystems without
+// fallocate support are left as they are.
+func preallocate(file File, size int64) error {
+	descriptor, ok := file.(interface{ Fd() uintptr })
+	if !ok {
+		return nil
+	}
+	err := syscall.Fallocate(int(descriptor.Fd()), fallocKeepSize, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+	return err
+}
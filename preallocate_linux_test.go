@@ -0,0 +1,62 @@
+package tinywal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPreallocateReservesSegment(t *testing.T) {
+	dir := t.TempDir()
+	probe, err := os.Create(filepath.Join(dir, "probe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Fallocate(int(probe.Fd()), fallocKeepSize, 0, 4096)
+	probe.Close()
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		t.Skip("filesystem doesn't support fallocate")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const segmentSize = 1 << 20
+	w := openWAL(t, dir, WithSegmentSize(segmentSize), WithPreallocate(true))
+	writeNumbered(t, w, 10)
+	err = w.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(w.CurrentSegment())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocks are reserved without growing the file, so it ends at its last
+	// record.
+	want := segmentHeaderSize + createdAtSize + 10*encodedSize(1)
+	if info.Size() != want {
+		t.Fatalf("segment is %d bytes, want %d", info.Size(), want)
+	}
+	if allocated := info.Sys().(*syscall.Stat_t).Blocks * 512; allocated < segmentSize {
+		t.Fatalf("%d bytes allocated, want at least %d", allocated, segmentSize)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, dir, WithSegmentSize(segmentSize), WithPreallocate(true))
+	if records := recoverAll(t, w); fmt.Sprint(records) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Fatalf("records = %q, want 0 to 9", records)
+	}
+	offset, err := w.Write([]byte("10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 10 {
+		t.Fatalf("offset = %d, want 10", offset)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package tinywal
+
+// preallocate does nothing where fallocate isn't available.
+func preallocate(file File, size int64) error {
+	return nil
+}
@@ -0,0 +1,163 @@
+package tinywal
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Reader iterates over a snapshot of the WAL taken by NewReader. It may be
+// used alongside writers, but a single Reader is not safe for concurrent use.
+type Reader struct {
+	storage      Storage
+	segments     []*segmentInfo
+	segment      File
+	segmentName  string
+	decoder      *segmentDecoder
+	payload      *payloadCodec
+	recoveryMode RecoveryMode
+	logger       *slog.Logger
+}
+
+func (w *WAL) NewReader() (*Reader, error) {
+	segmentsWithInfo, err := w.snapshotSegments()
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		storage:      w.storage,
+		segments:     segmentsWithInfo,
+		payload:      w.payload,
+		recoveryMode: w.recoveryMode,
+		logger:       w.logger,
+	}, nil
+}
+
+// Next returns the next valid record, walking segments oldest first. Records
+// failing checksum validation are skipped, and in lenient mode so are ones
+// whose length is corrupt. It returns io.EOF once every segment has been
+// read.
+func (r *Reader) Next() ([]byte, error) {
+	for {
+		if r.segment == nil {
+			if len(r.segments) == 0 {
+				return nil, io.EOF
+			}
+			err := r.openNextSegment()
+			if err != nil {
+				return nil, err
+			}
+			if r.segment == nil {
+				continue
+			}
+		}
+		record, err := r.decoder.next()
+		if err == nil {
+			data, err := r.payload.decode(record)
+			if err != nil {
+				return nil, err
+			}
+			return append([]byte{}, data...), nil
+		}
+		if err == ErrChecksumValidation {
+			r.logger.Warn("corrupt record", "segment", r.segmentName, "position", r.decoder.lastStart, "error", err)
+			if r.recoveryMode == RecoveryStrict {
+				return nil, err
+			}
+			_, err = r.decoder.resync()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err == ErrBytesLength && r.recoveryMode == RecoveryLenient {
+			corruptAt := r.decoder.lastStart
+			found, err := r.decoder.resync()
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				r.logger.Warn("corrupt record", "segment", r.segmentName, "position", corruptAt, "error", ErrChecksumValidation)
+				continue
+			}
+		}
+		if err != io.EOF {
+			r.logger.Warn("torn record", "segment", r.segmentName, "position", r.decoder.lastStart, "error", err)
+		}
+		err = r.closeSegment()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *Reader) Close() error {
+	r.segments = nil
+	return r.closeSegment()
+}
+
+func (r *Reader) openNextSegment() error {
+	segmentWithInfo := r.segments[0]
+	r.segments = r.segments[1:]
+	segment, decoder, err := openSegment(r.storage, segmentWithInfo)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.segment = segment
+	r.segmentName = segmentWithInfo.Name
+	r.decoder = decoder
+	return nil
+}
+
+func (r *Reader) closeSegment() error {
+	if r.segment == nil {
+		return nil
+	}
+	err := r.segment.Close()
+	r.segment = nil
+	r.decoder = nil
+	return err
+}
+
+// payloadReader streams the payloads of a Reader back to back.
+type payloadReader struct {
+	records *Reader
+	pending []byte
+	err     error
+}
+
+// PayloadReader returns the payloads of every record, oldest first, as one
+// continuous stream with no separators. Records are read from a snapshot
+// like NewReader's, and a record failing checksum validation ends the
+// stream with ErrChecksumValidation whatever the recovery mode.
+func (w *WAL) PayloadReader() io.ReadCloser {
+	records, err := w.NewReader()
+	if err != nil {
+		return &payloadReader{err: err}
+	}
+	records.recoveryMode = RecoveryStrict
+	return &payloadReader{records: records}
+}
+
+func (p *payloadReader) Read(b []byte) (int, error) {
+	for len(p.pending) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		p.pending, p.err = p.records.Next()
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *payloadReader) Close() error {
+	if p.records == nil {
+		return nil
+	}
+	return p.records.Close()
+}
@@ -0,0 +1,172 @@
+package tinywal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// readAll drains a new Reader over w.
+func readAll(w *WAL) ([]string, error) {
+	reader, err := w.NewReader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var records []string
+	for {
+		data, err := reader.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, string(data))
+	}
+}
+
+func TestReadersAlongsideWriter(t *testing.T) {
+	const total = 500
+	w := openWAL(t, t.TempDir(), WithSegmentSize(256), WithMaxSegments(1000))
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < total; i++ {
+			_, err := w.Write([]byte(fmt.Sprint(i)))
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for r := 0; r < 3; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pass := 0; pass < 20; pass++ {
+				records, err := readAll(w)
+				if err != nil {
+					errs <- err
+					return
+				}
+				// Every snapshot is a prefix of what was written.
+				for i, record := range records {
+					if record != fmt.Sprint(i) {
+						errs <- fmt.Errorf("record %d = %q", i, record)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	records, err := readAll(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != total {
+		t.Fatalf("read %d records, want %d", len(records), total)
+	}
+}
+
+func TestReaderSkipsSegmentsRemovedAfterSnapshot(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(100))
+	writeNumbered(t, w, 10)
+	reader, err := w.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	err = w.TruncateBefore(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []string
+	for {
+		data, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, string(data))
+	}
+	if len(records) == 0 || records[len(records)-1] != "9" {
+		t.Fatalf("records = %q, want the retained tail", records)
+	}
+}
+
+func TestRecoverSeesBufferedRecords(t *testing.T) {
+	w := openWAL(t, t.TempDir(), WithSyncMode(SyncNever))
+	writeNumbered(t, w, 3)
+	if records := recoverAll(t, w); len(records) != 3 {
+		t.Fatalf("Recover returned %q, want all 3 records", records)
+	}
+	_, err := w.Write([]byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := readAll(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("Reader returned %q, want all 4 records", records)
+	}
+}
+
+func TestPayloadReaderStreamsRecords(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(100))
+	var want bytes.Buffer
+	for i := 0; i < 50; i++ {
+		record := []byte(fmt.Sprintf("record %d\n", i))
+		want.Write(record)
+		_, err := w.Write(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream := w.PayloadReader()
+	defer stream.Close()
+	// A small buffer makes reads split records.
+	got, err := io.ReadAll(bufio.NewReaderSize(stream, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("stream = %q, want %q", got, want.Bytes())
+	}
+}
+
+func TestPayloadReaderFailsOnCorruption(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	writeNumbered(t, w, 5)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptSegment(t, dir, 2, recordHeaderSize(segmentVersion))
+	w = openWAL(t, dir)
+	stream := w.PayloadReader()
+	defer stream.Close()
+	got, err := io.ReadAll(stream)
+	if !errors.Is(err, ErrChecksumValidation) {
+		t.Fatalf("err = %v, want ErrChecksumValidation", err)
+	}
+	if string(got) != "01" {
+		t.Fatalf("read %q before the corruption, want \"01\"", got)
+	}
+}
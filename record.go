@@ -0,0 +1,175 @@
+package tinywal
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// RecordEncoder frames records in the current segment format, described on
+// DecodeSegment.
+type RecordEncoder struct {
+	checksums *checksummer
+}
+
+func NewRecordEncoder(checksum ChecksumAlgorithm) (*RecordEncoder, error) {
+	if !checksum.known() {
+		return nil, ErrUnknownChecksum
+	}
+	return &RecordEncoder{checksums: checksum.checksummer()}, nil
+}
+
+// EncodeTo writes a single record carrying data as an uncompressed,
+// unencrypted payload.
+func (e *RecordEncoder) EncodeTo(w io.Writer, offset uint64, data []byte) error {
+	return e.encodeTo(w, offset, 0, 0, data)
+}
+
+// encodeTo frames the whole record before handing it to w in a single
+// Write, so a buffered writer never holds a header without its payload. A
+// short write straight to a file can still leave part of a record, which
+// the WAL cuts off again.
+func (e *RecordEncoder) encodeTo(w io.Writer, offset uint64, flags byte, recordType uint16, data []byte) error {
+	size := recordHeaderSize(segmentVersion)
+	record := make([]byte, encodedSize(len(data)))
+	header := record[:size]
+	binary.LittleEndian.PutUint64(header[0:8], offset)
+	binary.LittleEndian.PutUint32(header[8:12], uint32(len(data)))
+	header[16] = flags
+	binary.LittleEndian.PutUint16(header[17:19], recordType)
+	binary.LittleEndian.PutUint32(header[12:16], recordChecksum(e.checksums, header, data))
+	copy(record[size:], data)
+
+	_, err := w.Write(record)
+	return err
+}
+
+// encodedSize returns the bytes a record with the given payload length
+// occupies on disk.
+func encodedSize(length int) int64 {
+	return int64(recordHeaderSize(segmentVersion) + length)
+}
+
+// noChecksum fills the checksum field under ChecksumNone. It isn't zero,
+// so an empty record at offset 0 is never mistaken for zero padding.
+const noChecksum = 0xffffffff
+
+// recordChecksum covers every header field except the checksum itself,
+// followed by the payload. Without checksums, for ChecksumNone, it is
+// noChecksum.
+func recordChecksum(checksums *checksummer, header []byte, data []byte) uint32 {
+	if checksums == nil {
+		return noChecksum
+	}
+	return checksums.checksum(header[:12], header[16:], data)
+}
+
+// recordHeaderSize returns the framing header length for a segment version.
+// Version 1 is offset(8) | len(4) | checksum(4); version 2 appends flags(1)
+// and version 3 type(2).
+func recordHeaderSize(version byte) int {
+	switch {
+	case version < 2:
+		return headerSize
+	case version < 3:
+		return headerSize + 1
+	}
+	return headerSize + 3
+}
+
+// recordTrailerSize returns the bytes following each payload in a segment
+// version. Before version 5 every record ended with a '\n'.
+func recordTrailerSize(version byte) int {
+	if version < 5 {
+		return 1
+	}
+	return 0
+}
+
+// RecordDecoder parses records produced by RecordEncoder.
+type RecordDecoder struct {
+	checksums   *checksummer
+	headerSize  int
+	trailerSize int
+	header      []byte
+	buf         []byte
+}
+
+func NewRecordDecoder(checksum ChecksumAlgorithm) (*RecordDecoder, error) {
+	if !checksum.known() {
+		return nil, ErrUnknownChecksum
+	}
+	return newRecordDecoder(segmentVersion, checksum.checksummer()), nil
+}
+
+func newRecordDecoder(version byte, checksums *checksummer) *RecordDecoder {
+	size := recordHeaderSize(version)
+	return &RecordDecoder{
+		checksums:   checksums,
+		headerSize:  size,
+		trailerSize: recordTrailerSize(version),
+		header:      make([]byte, size),
+		buf:         make([]byte, 0, 4096),
+	}
+}
+
+// DecodeFrom reads a single record and returns its offset and stored
+// payload. It returns io.EOF if r has no more data, ErrBytesLength if r ends
+// mid-record and ErrChecksumValidation if the record is corrupt.
+func (d *RecordDecoder) DecodeFrom(r io.Reader) (uint64, []byte, error) {
+	record, _, err := d.decode(r, -1)
+	if err != nil {
+		return 0, nil, err
+	}
+	return record.offset, append([]byte{}, record.data...), nil
+}
+
+// decode reads the next record into the decoder's buffer and returns it with
+// the number of bytes consumed. When remaining isn't negative it bounds the
+// record size, so a corrupt length can't trigger a huge allocation.
+func (d *RecordDecoder) decode(r io.Reader, remaining int64) (rawRecord, int64, error) {
+	_, err := io.ReadFull(r, d.header)
+	if err == io.EOF {
+		return rawRecord{}, 0, io.EOF
+	}
+	if err != nil {
+		return rawRecord{}, 0, ErrBytesLength
+	}
+
+	length := binary.LittleEndian.Uint32(d.header[8:12])
+	recordSize := int(length) + d.trailerSize
+	size := int64(d.headerSize + recordSize)
+	if remaining >= 0 && size > remaining {
+		return rawRecord{}, 0, ErrBytesLength
+	}
+	if cap(d.buf) < recordSize {
+		d.buf = make([]byte, recordSize)
+	}
+	d.buf = d.buf[:recordSize]
+	_, err = io.ReadFull(r, d.buf)
+	if err != nil {
+		return rawRecord{}, 0, ErrBytesLength
+	}
+	data := d.buf[:length]
+
+	precomputedChecksum := binary.LittleEndian.Uint32(d.header[12:16])
+	if precomputedChecksum != recordChecksum(d.checksums, d.header, data) {
+		return rawRecord{}, size, ErrChecksumValidation
+	}
+	record := rawRecord{
+		offset: binary.LittleEndian.Uint64(d.header[0:8]),
+		data:   data,
+	}
+	if d.headerSize > headerSize {
+		record.flags = d.header[16]
+	}
+	if d.headerSize > headerSize+1 {
+		record.recordType = binary.LittleEndian.Uint16(d.header[17:19])
+	}
+	return record, size, nil
+}
+
+// validAt reports whether an intact record starts at position in source.
+func (d *RecordDecoder) validAt(source io.ReaderAt, position int64, size int64) bool {
+	_, _, err := d.decode(io.NewSectionReader(source, position, size-position), size-position)
+	return err == nil
+}
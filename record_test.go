@@ -0,0 +1,141 @@
+package tinywal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func encodeRecord(t *testing.T, offset uint64, data []byte) []byte {
+	t.Helper()
+	encoder, err := NewRecordEncoder(ChecksumIEEE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = encoder.EncodeTo(&buf, offset, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestChecksumCoversFraming(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		position int
+	}{
+		{"offset", 0},
+		{"length", 8},
+		{"payload", recordHeaderSize(segmentVersion)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			record := encodeRecord(t, 7, []byte("payload"))
+			// The flipped length bit shrinks it to 6, so the record still
+			// fits and only the checksum can catch it.
+			record[test.position] ^= 1
+			decoder, err := NewRecordDecoder(ChecksumIEEE)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = decoder.DecodeFrom(bytes.NewReader(record))
+			if err != ErrChecksumValidation {
+				t.Fatalf("err = %v, want ErrChecksumValidation", err)
+			}
+		})
+	}
+}
+
+func TestRecordCodecRoundTrip(t *testing.T) {
+	payloads := [][]byte{{}, []byte("a"), []byte("line\n"), bytes.Repeat([]byte{0xff}, 10000)}
+	encoder, err := NewRecordEncoder(ChecksumCastagnoli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	for i, payload := range payloads {
+		err := encoder.EncodeTo(&buf, uint64(i+100), payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	decoder, err := NewRecordDecoder(ChecksumCastagnoli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, payload := range payloads {
+		offset, data, err := decoder.DecodeFrom(&buf)
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if offset != uint64(i+100) || !bytes.Equal(data, payload) {
+			t.Fatalf("record %d = %d %q, want %d %q", i, offset, data, i+100, payload)
+		}
+	}
+	_, _, err = decoder.DecodeFrom(&buf)
+	if err != io.EOF {
+		t.Fatalf("err = %v, want io.EOF", err)
+	}
+}
+
+func TestRecordDecoderRejectsShortRecord(t *testing.T) {
+	record := encodeRecord(t, 0, []byte("payload"))
+	decoder, err := NewRecordDecoder(ChecksumIEEE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{1, recordHeaderSize(segmentVersion), len(record) - 1} {
+		_, _, err = decoder.DecodeFrom(bytes.NewReader(record[:size]))
+		if err != ErrBytesLength {
+			t.Fatalf("%d bytes: err = %v, want ErrBytesLength", size, err)
+		}
+	}
+}
+
+func TestRecordCodecRejectsUnknownChecksum(t *testing.T) {
+	_, err := NewRecordEncoder(ChecksumNone + 1)
+	if err != ErrUnknownChecksum {
+		t.Fatalf("encoder err = %v, want ErrUnknownChecksum", err)
+	}
+	_, err = NewRecordDecoder(ChecksumNone + 1)
+	if err != ErrUnknownChecksum {
+		t.Fatalf("decoder err = %v, want ErrUnknownChecksum", err)
+	}
+}
+
+func TestFailedLargeRecordLeavesNothingPartial(t *testing.T) {
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithBufferSize(64), WithSyncPeriod(time.Hour))
+	writeNumbered(t, w, 2)
+	// The buffered records and the header fit, half of the large record
+	// doesn't.
+	large := bytes.Repeat([]byte("x"), 200)
+	storage.limitSpace(segmentHeaderSize + createdAtSize + 2*encodedSize(1) + encodedSize(len(large))/2)
+	_, err := w.Write(large)
+	if !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("err = %v, want ErrDiskFull", err)
+	}
+	name := filepath.Base(w.CurrentSegment())
+	size, err := storage.Size(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := segmentHeaderSize + createdAtSize + 2*encodedSize(1); size != want {
+		t.Fatalf("segment is %d bytes, want it cut back to the record's start at %d", size, want)
+	}
+	storage.limitSpace(-1)
+	offset, err := w.Write(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 2 {
+		t.Fatalf("offset = %d, want 2", offset)
+	}
+	records := recoverAll(t, w)
+	if len(records) != 3 || records[1] != "1" || records[2] != string(large) {
+		t.Fatalf("recovered %d records, want 0, 1 and the large one", len(records))
+	}
+}
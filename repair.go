@@ -0,0 +1,65 @@
+package tinywal
+
+// RepairSegment truncates the segment with the given index at its first
+// corrupt or torn record, so later recovery of it is clean, and returns how
+// many bytes it discarded. It returns ErrSegmentNotFound if no such segment
+// exists. A read-only WAL returns ErrReadOnly unless AllowRepair is set, in
+// which case it may repair any segment, including the newest one holding a
+// crash's torn tail. A writable WAL returns ErrActiveSegment for the newest
+// segment, which it is writing to; TruncateTornTail handles a torn tail
+// there when the WAL is opened.
+func (w *WAL) RepairSegment(index uint64) (int64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, ErrWALClosed
+	}
+	if w.readOnly && !w.allowRepair {
+		return 0, ErrReadOnly
+	}
+	segmentsWithInfo, err := w.getSortedSegments()
+	if err != nil {
+		return 0, err
+	}
+	for i, segmentWithInfo := range segmentsWithInfo {
+		if segmentWithInfo.Index != index {
+			continue
+		}
+		if i == len(segmentsWithInfo)-1 && !w.readOnly {
+			return 0, ErrActiveSegment
+		}
+		return w.repairSegment(segmentWithInfo)
+	}
+	return 0, ErrSegmentNotFound
+}
+
+func (w *WAL) repairSegment(segmentWithInfo *segmentInfo) (int64, error) {
+	segment, err := w.storage.Open(segmentWithInfo.Name)
+	if err != nil {
+		return 0, err
+	}
+	size, err := segment.Size()
+	segment.Close()
+	if err != nil {
+		return 0, err
+	}
+	scan, err := w.scanSegment(segmentWithInfo, RecoveryLenient, func(rawRecord) error {
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	validSize := scan.validSize
+	if scan.corrupted > 0 {
+		validSize = scan.corruptAt[0]
+	}
+	if validSize >= size {
+		return 0, nil
+	}
+	err = w.storage.Truncate(segmentWithInfo.Name, validSize)
+	if err != nil {
+		return 0, err
+	}
+	w.index.reset()
+	return size - validSize, w.buildIndex()
+}
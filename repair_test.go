@@ -0,0 +1,134 @@
+package tinywal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// damagedWAL leaves dir with a first segment of five records that is torn,
+// or corrupt at offset 2, and returns a WAL that has rotated on to a later
+// segment.
+func damagedWAL(t *testing.T, dir string, torn bool) *WAL {
+	t.Helper()
+	w := openWAL(t, dir)
+	writeNumbered(t, w, 5)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torn {
+		appendTornRecord(t, dir, 5)
+	} else {
+		corruptSegment(t, dir, 2, recordHeaderSize(segmentVersion))
+	}
+	w = openWAL(t, dir)
+	err = w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestRepairSegment(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		torn    bool
+		removed int64
+		want    string
+	}{
+		// Half of a record holding "torn record" was appended.
+		{"torn", true, encodedSize(len("torn record")) / 2, "[0 1 2 3 4]"},
+		{"corrupt", false, 3 * encodedSize(1), "[0 1]"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := damagedWAL(t, t.TempDir(), test.torn)
+			removed, err := w.RepairSegment(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != test.removed {
+				t.Fatalf("removed %d bytes, want %d", removed, test.removed)
+			}
+			report, err := w.Verify()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !report.OK() {
+				t.Fatalf("Verify after repair = %+v", report)
+			}
+			if records := recoverAll(t, w); fmt.Sprint(records) != test.want {
+				t.Fatalf("records = %q, want %s", records, test.want)
+			}
+			removed, err = w.RepairSegment(1)
+			if err != nil || removed != 0 {
+				t.Fatalf("second repair = %d, %v; want nothing to do", removed, err)
+			}
+		})
+	}
+}
+
+func TestRepairSegmentRefusals(t *testing.T) {
+	w := damagedWAL(t, t.TempDir(), true)
+	_, err := w.RepairSegment(100)
+	if !errors.Is(err, ErrSegmentNotFound) {
+		t.Fatalf("missing segment: err = %v, want ErrSegmentNotFound", err)
+	}
+	segments, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.RepairSegment(segments[len(segments)-1].Index)
+	if !errors.Is(err, ErrActiveSegment) {
+		t.Fatalf("active segment: err = %v, want ErrActiveSegment", err)
+	}
+}
+
+func TestRepairSegmentReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	writeNumbered(t, w, 5)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A crash tore the tail of the newest segment.
+	appendTornRecord(t, dir, 5)
+	before := readSegmentFiles(t, dir)
+	reader, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	_, err = reader.RepairSegment(1)
+	if !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("err = %v, want ErrReadOnly without AllowRepair", err)
+	}
+	if !bytes.Equal(readSegmentFiles(t, dir), before) {
+		t.Fatal("read-only WAL modified a segment")
+	}
+
+	repairer, err := OpenReadOnly(dir, WithAllowRepair(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repairer.Close()
+	segments, err := repairer.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("got %d segments, want 1", len(segments))
+	}
+	removed, err := repairer.RepairSegment(segments[0].Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != encodedSize(len("torn record"))/2 {
+		t.Fatalf("removed %d bytes, want the torn half record", removed)
+	}
+	if records := recoverAll(t, repairer); fmt.Sprint(records) != "[0 1 2 3 4]" {
+		t.Fatalf("records = %q, want 0 to 4", records)
+	}
+}
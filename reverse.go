@@ -0,0 +1,109 @@
+package tinywal
+
+import (
+	"errors"
+	"os"
+)
+
+// RecoverReverse replays every record newest first, walking segments in
+// descending order and each segment's records backwards. A segment is read
+// twice: once to find its record boundaries and once to replay them. Like
+// Recover, it stops at the first error from callback.
+func (w *WAL) RecoverReverse(callback func([]byte) error) error {
+	segmentsWithInfo, err := w.snapshotSegments()
+	if err != nil {
+		return err
+	}
+	for i := len(segmentsWithInfo) - 1; i >= 0; i-- {
+		err = w.recoverSegmentReverse(segmentsWithInfo[i], func(record rawRecord) error {
+			return callback(record.data)
+		})
+		if err != nil {
+			return stopped(err)
+		}
+	}
+	return nil
+}
+
+// recoverSegmentReverse calls callback with a segment's records newest
+// first, their data replaced by the decoded payload.
+func (w *WAL) recoverSegmentReverse(segmentWithInfo *segmentInfo, callback func(rawRecord) error) error {
+	var positions []int64
+	_, err := w.scanSegment(segmentWithInfo, w.recoveryMode, func(record rawRecord) error {
+		positions = append(positions, record.position)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(positions) == 0 {
+		return nil
+	}
+	segment, decoder, err := openSegment(w.storage, segmentWithInfo)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer segment.Close()
+	for i := len(positions) - 1; i >= 0; i-- {
+		err = decoder.seek(positions[i])
+		if err != nil {
+			return err
+		}
+		record, err := decoder.next()
+		if err != nil {
+			return err
+		}
+		record.data, err = w.payload.decode(record)
+		if err != nil {
+			return err
+		}
+		err = callback(record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tail replays the last n records in order. It counts records from the
+// newest segment backwards so only the segments holding them are read.
+func (w *WAL) Tail(n int, callback func([]byte) error) error {
+	if n <= 0 {
+		return nil
+	}
+	segmentsWithInfo, err := w.snapshotSegments()
+	if err != nil {
+		return err
+	}
+	first := len(segmentsWithInfo)
+	count := 0
+	for first > 0 && count < n {
+		first -= 1
+		_, err = w.scanSegment(segmentsWithInfo[first], w.recoveryMode, func(record rawRecord) error {
+			count += 1
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	skip := count - n
+	for _, segmentWithInfo := range segmentsWithInfo[first:] {
+		_, err = w.recoverSegment(segmentWithInfo, func(record rawRecord) bool {
+			if skip > 0 {
+				skip -= 1
+				return false
+			}
+			return true
+		}, func(record rawRecord) error {
+			return callback(record.data)
+		})
+		if err != nil {
+			return stopped(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package tinywal
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRecoverReverse(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(100))
+	writeNumbered(t, w, 10)
+	segments, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 3 {
+		t.Fatalf("got %d segments, want several", len(segments))
+	}
+	var backward []string
+	err = w.RecoverReverse(func(data []byte) error {
+		backward = append(backward, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(backward) != "[9 8 7 6 5 4 3 2 1 0]" {
+		t.Fatalf("reverse records = %q, want 9 down to 0", backward)
+	}
+	if forward := recoverAll(t, w); fmt.Sprint(forward) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Fatalf("records = %q, want 0 to 9", forward)
+	}
+}
+
+func TestRecoverReverseStopsEarly(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(100))
+	writeNumbered(t, w, 10)
+	var backward []string
+	err := w.RecoverReverse(func(data []byte) error {
+		backward = append(backward, string(data))
+		if len(backward) == 3 {
+			return ErrStopRecovery
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(backward) != "[9 8 7]" {
+		t.Fatalf("reverse records = %q, want [9 8 7]", backward)
+	}
+}
+
+func TestTail(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(100))
+	writeNumbered(t, w, 10)
+	segments, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := segments[len(segments)-1].Records
+	for _, test := range []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"within the active segment", 1, "[9]"},
+		{"spanning segments", active + 2, fmt.Sprint(allOf(10)[10-active-2:])},
+		{"more than written", 50, fmt.Sprint(allOf(10))},
+		{"none", 0, "[]"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			err := w.Tail(test.n, func(data []byte) error {
+				got = append(got, string(data))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != test.want {
+				t.Fatalf("Tail(%d) = %q, want %s", test.n, got, test.want)
+			}
+		})
+	}
+}
+
+// allOf returns the records writeNumbered writes.
+func allOf(n int) []string {
+	records := make([]string, n)
+	for i := range records {
+		records[i] = fmt.Sprint(i)
+	}
+	return records
+}
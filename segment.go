@@ -0,0 +1,378 @@
+package tinywal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	segmentMagic      = "TWAL"
+	segmentVersion    = 5
+	segmentHeaderSize = 8
+	createdAtSize     = 8
+	headerSize        = 16
+)
+
+// minSegmentSize fits the segment header and one empty record.
+var minSegmentSize = segmentSizeFor(0)
+
+// segmentSizeFor returns the smallest segment that holds its header and a
+// record with a payload of maxRecordSize bytes, so that no record Write
+// accepts overflows a fresh segment.
+func segmentSizeFor(maxRecordSize int64) int64 {
+	return segmentHeaderSize + createdAtSize + encodedSize(0) + maxRecordSize
+}
+
+type ChecksumAlgorithm uint8
+
+const (
+	ChecksumIEEE ChecksumAlgorithm = iota
+	ChecksumCastagnoli
+	// ChecksumNone skips computing and verifying record checksums, for
+	// trusted, short-lived logs where the cost matters more than detecting
+	// corruption. Corrupt records can't be told apart from intact ones, so
+	// resynchronization is not attempted.
+	ChecksumNone
+)
+
+var (
+	ieeeChecksummer       = &checksummer{table: crc32.IEEETable}
+	castagnoliChecksummer = &checksummer{table: crc32.MakeTable(crc32.Castagnoli)}
+
+	registeredLock      sync.RWMutex
+	registeredChecksums = map[ChecksumAlgorithm]*checksummer{}
+)
+
+// RegisterChecksum plugs in sum, such as a truncated xxhash, as a checksum
+// algorithm WithChecksum can select. algorithm is the byte stored in each
+// segment header, so it must be above ChecksumNone and name the same
+// function in every process reading the WAL; register it before opening
+// one. It returns ErrInvalidChecksum if algorithm is built in or already
+// registered, or sum is nil.
+func RegisterChecksum(algorithm ChecksumAlgorithm, sum func([]byte) uint32) error {
+	if algorithm <= ChecksumNone || sum == nil {
+		return ErrInvalidChecksum
+	}
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+	if registeredChecksums[algorithm] != nil {
+		return ErrInvalidChecksum
+	}
+	registeredChecksums[algorithm] = &checksummer{sum: sum}
+	return nil
+}
+
+func (c ChecksumAlgorithm) known() bool {
+	return c == ChecksumNone || c.checksummer() != nil
+}
+
+// checksummer returns nil for ChecksumNone and unknown algorithms.
+func (c ChecksumAlgorithm) checksummer() *checksummer {
+	switch c {
+	case ChecksumIEEE:
+		return ieeeChecksummer
+	case ChecksumCastagnoli:
+		return castagnoliChecksummer
+	}
+	registeredLock.RLock()
+	defer registeredLock.RUnlock()
+	return registeredChecksums[c]
+}
+
+// checksummer computes checksums with a built-in CRC-32 table or a
+// registered function.
+type checksummer struct {
+	table *crc32.Table
+	sum   func([]byte) uint32
+}
+
+// checksum covers parts as if they were one slice.
+func (c *checksummer) checksum(parts ...[]byte) uint32 {
+	if c.table != nil {
+		var checksum uint32
+		for _, part := range parts {
+			checksum = crc32.Update(checksum, c.table, part)
+		}
+		return checksum
+	}
+	if len(parts) == 1 {
+		return c.sum(parts[0])
+	}
+	var joined []byte
+	for _, part := range parts {
+		joined = append(joined, part...)
+	}
+	return c.sum(joined)
+}
+
+// The segment header is magic(4) | version(1) | checksum(1) | reserved(2)
+// | created(8), the creation time in Unix nanoseconds.
+func encodeSegmentHeader(checksum ChecksumAlgorithm, created time.Time) []byte {
+	header := make([]byte, segmentHeaderSize+createdAtSize)
+	copy(header, segmentMagic)
+	header[4] = segmentVersion
+	header[5] = byte(checksum)
+	binary.LittleEndian.PutUint64(header[segmentHeaderSize:], uint64(created.UnixNano()))
+	return header
+}
+
+// DecodeSegment parses a segment file's contents without opening a WAL and
+// calls fn with each record in order. Compressed payloads are
+// decompressed with the built-in codecs; encrypted ones can't be read and
+// yield ErrNoEncryptionKey. Decoding stops at the first record that fails
+// validation, returning ErrChecksumValidation, or ErrBytesLength if the
+// segment ends mid-record. A header of an unknown version yields
+// ErrUnsupportedFormat.
+//
+// A segment starts with a 16 byte header:
+//
+//	magic "TWAL" (4) | format version (1) | checksum algorithm (1) | reserved (2) | created (8)
+//
+// where created is the segment's creation time in Unix nanoseconds; before
+// version 4 the header ends after the reserved bytes. It is followed by
+// records, with all integers little endian:
+//
+//	offset (8) | payload length (4) | checksum (4) | flags (1) | type (2) | payload
+//
+// The checksum covers every header field except itself, then the payload.
+// The low four bits of flags hold the compression codec ID and bit 4 marks
+// an encrypted payload. Type is the application's record type, 0 unless set
+// with WriteTyped. Before version 5 each payload is followed by a '\n'.
+// Version 2 segments have no type field. Version 1 segments, and segments
+// without a header, have no flags byte either and always use IEEE
+// checksums.
+func DecodeSegment(r io.Reader, fn func(offset uint64, data []byte) error) error {
+	decoder, err := newSegmentDecoder(r)
+	if err != nil {
+		return err
+	}
+	payload := &payloadCodec{}
+	for {
+		record, err := decoder.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, err := payload.decode(record)
+		if err != nil {
+			return err
+		}
+		err = fn(record.offset, data)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type segmentDecoder struct {
+	reader    *bufio.Reader
+	source    *io.SectionReader
+	records   *RecordDecoder
+	version   byte
+	checksum  ChecksumAlgorithm
+	created   time.Time
+	pos       int64
+	lastStart int64
+	// padded is set once the records have been found to end in zero
+	// padding, which starts at pos.
+	padded bool
+}
+
+type rawRecord struct {
+	offset     uint64
+	flags      byte
+	recordType uint16
+	data       []byte
+	position   int64
+}
+
+// newSegmentDecoder consumes the segment header from r. Segments written
+// before the header existed are read as version 1 IEEE checksummed records,
+// provided, when r is seekable, that they start with an intact record;
+// anything else, like a header of an unknown version, is rejected with
+// ErrUnsupportedFormat.
+func newSegmentDecoder(r io.Reader) (*segmentDecoder, error) {
+	decoder := &segmentDecoder{
+		reader:  bufio.NewReader(r),
+		version: 1,
+	}
+	if source, ok := r.(*io.SectionReader); ok {
+		decoder.source = source
+	}
+	header, err := decoder.reader.Peek(segmentHeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(header) < segmentHeaderSize && truncatedHeader(header) {
+		// The segment was created but a crash cut its header short, so it
+		// holds no records.
+		return decoder.empty(len(header))
+	}
+	if len(header) < segmentHeaderSize || string(header[:4]) != segmentMagic {
+		decoder.records = newRecordDecoder(decoder.version, ieeeChecksummer)
+		if decoder.source != nil && !decoder.records.validAt(decoder.source, 0, decoder.source.Size()) {
+			return nil, ErrUnsupportedFormat
+		}
+		return decoder, nil
+	}
+	decoder.version = header[4]
+	if decoder.version == 0 || decoder.version > segmentVersion {
+		return nil, ErrUnsupportedFormat
+	}
+	decoder.checksum = ChecksumAlgorithm(header[5])
+	if !decoder.checksum.known() {
+		return nil, ErrUnknownChecksum
+	}
+	checksums := decoder.checksum.checksummer()
+	size := segmentHeaderSize
+	if decoder.version >= 4 {
+		size += createdAtSize
+		header, err = decoder.reader.Peek(size)
+		if err == io.EOF {
+			return decoder.empty(len(header))
+		}
+		if err != nil {
+			return nil, err
+		}
+		created := int64(binary.LittleEndian.Uint64(header[segmentHeaderSize:]))
+		decoder.created = time.Unix(0, created)
+	}
+	_, err = decoder.reader.Discard(size)
+	if err != nil {
+		return nil, err
+	}
+	decoder.pos = int64(size)
+	decoder.records = newRecordDecoder(decoder.version, checksums)
+	return decoder, nil
+}
+
+// truncatedHeader reports whether b, which is shorter than a segment header,
+// could be the start of one.
+func truncatedHeader(b []byte) bool {
+	n := min(len(b), len(segmentMagic))
+	return string(b[:n]) == segmentMagic[:n]
+}
+
+// empty positions the decoder after the size bytes of a segment holding no
+// records, so that next returns io.EOF.
+func (d *segmentDecoder) empty(size int) (*segmentDecoder, error) {
+	_, err := d.reader.Discard(size)
+	if err != nil {
+		return nil, err
+	}
+	d.version = segmentVersion
+	d.pos = int64(size)
+	d.records = newRecordDecoder(d.version, ieeeChecksummer)
+	return d, nil
+}
+
+// next reads the next framed record. The returned data is only valid until
+// the following call. It returns io.EOF at a clean end of segment, including
+// where the records give way to zero padding, and ErrBytesLength for a
+// truncated record, in which case pos is the end of the last complete record.
+func (d *segmentDecoder) next() (rawRecord, error) {
+	d.lastStart = d.pos
+	if d.atPadding() {
+		d.padded = true
+		return rawRecord{}, io.EOF
+	}
+	remaining := int64(-1)
+	if d.source != nil {
+		remaining = d.source.Size() - d.pos
+	}
+	record, size, err := d.records.decode(d.reader, remaining)
+	record.position = d.lastStart
+	d.pos += size
+	return record, err
+}
+
+// atPadding reports whether the segment holds only zeros from pos on. No
+// record header is all zeros, since its checksum field never is, so an all
+// zero header ends the data; when the segment is seekable the rest of it must
+// be zeros too, so a zeroed block mid-segment is still resynchronized past.
+func (d *segmentDecoder) atPadding() bool {
+	header, _ := d.reader.Peek(d.records.headerSize)
+	if len(header) < d.records.headerSize || !zeroed(header) {
+		return false
+	}
+	if d.source == nil {
+		return true
+	}
+	chunk := make([]byte, 4096)
+	for position := d.pos; position < d.source.Size(); {
+		n, err := d.source.ReadAt(chunk, position)
+		if !zeroed(chunk[:n]) {
+			return false
+		}
+		if err != nil {
+			return err == io.EOF
+		}
+		position += int64(n)
+	}
+	return true
+}
+
+func zeroed(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// seek positions the decoder at the record starting at position, which must
+// be a record boundary. The decoder must have been opened on a seekable
+// segment.
+func (d *segmentDecoder) seek(position int64) error {
+	_, err := d.source.Seek(position, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	d.reader.Reset(d.source)
+	d.pos = position
+	return nil
+}
+
+// reopen continues decoding at pos from source, a later view of the same
+// segment that may have grown since the decoder was opened.
+func (d *segmentDecoder) reopen(source *io.SectionReader) error {
+	d.source = source
+	return d.seek(d.pos)
+}
+
+// resync moves past the record that last failed to decode by scanning
+// forward one byte at a time for framing whose checksum is intact, and
+// reports whether one was found. It is a no-op when the segment isn't
+// seekable or has no checksums, leaving the decoder to trust the corrupt
+// length. If no valid record follows, the next call returns io.EOF.
+func (d *segmentDecoder) resync() (bool, error) {
+	if d.source == nil || d.records.checksums == nil {
+		return false, nil
+	}
+	size := d.source.Size()
+	target := size
+	for candidate := d.lastStart + 1; candidate+int64(d.records.headerSize) <= size; candidate++ {
+		if d.records.validAt(d.source, candidate, size) {
+			target = candidate
+			break
+		}
+	}
+	_, err := d.source.Seek(target, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	d.reader.Reset(d.source)
+	if target == size {
+		d.pos = d.lastStart
+		return false, nil
+	}
+	d.pos = target
+	return true, nil
+}
@@ -0,0 +1,441 @@
+package tinywal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checksumFNV is a registered checksum, FNV-1a, standing in for one such as
+// xxhash.
+const checksumFNV ChecksumAlgorithm = 200
+
+var registerFNV sync.Once
+
+func fnvChecksum(data []byte) uint32 {
+	hash := fnv.New32a()
+	hash.Write(data)
+	return hash.Sum32()
+}
+
+func useFNV(t testing.TB) {
+	registerFNV.Do(func() {
+		err := RegisterChecksum(checksumFNV, fnvChecksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestChecksumRoundTrip(t *testing.T) {
+	useFNV(t)
+	for name, algorithm := range map[string]ChecksumAlgorithm{
+		"ieee":       ChecksumIEEE,
+		"castagnoli": ChecksumCastagnoli,
+		"registered": checksumFNV,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := openWAL(t, dir, WithChecksum(algorithm))
+			_, err := w.Write([]byte("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w = openWAL(t, dir, WithChecksum(algorithm), WithRecoveryMode(RecoveryStrict))
+			records := recoverAll(t, w)
+			if len(records) != 1 || records[0] != "payload" {
+				t.Fatalf("records = %q, want [payload]", records)
+			}
+		})
+	}
+}
+
+func BenchmarkChecksum(b *testing.B) {
+	for _, bench := range []struct {
+		name      string
+		algorithm ChecksumAlgorithm
+	}{
+		{"none", ChecksumNone},
+		{"ieee", ChecksumIEEE},
+		{"castagnoli", ChecksumCastagnoli},
+		{"registered", checksumFNV},
+	} {
+		useFNV(b)
+		b.Run(bench.name, func(b *testing.B) {
+			w, err := NewWithOptions(b.TempDir(), WithSegmentSize(64<<20), WithChecksum(bench.algorithm))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer w.Close()
+			data := bytes.Repeat([]byte("x"), 512)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := w.Write(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisteredChecksumDetectsCorruption(t *testing.T) {
+	useFNV(t)
+	dir := t.TempDir()
+	w := openWAL(t, dir, WithChecksum(checksumFNV))
+	writeNumbered(t, w, 5)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := readSegmentFiles(t, dir)
+	if data[5] != byte(checksumFNV) {
+		t.Fatalf("segment header names checksum %d, want %d", data[5], checksumFNV)
+	}
+	corruptSegment(t, dir, 2, recordHeaderSize(segmentVersion))
+	// Recovery picks the function from the segment header, whatever the
+	// configured algorithm.
+	w = openWAL(t, dir, WithRecoveryMode(RecoveryStrict))
+	var records []string
+	err = w.Recover(func(data []byte) error {
+		records = append(records, string(data))
+		return nil
+	})
+	if !errors.Is(err, ErrChecksumValidation) || fmt.Sprint(records) != "[0 1]" {
+		t.Fatalf("recovered %q, %v; want [0 1] and ErrChecksumValidation", records, err)
+	}
+}
+
+func TestRegisterChecksumRefusals(t *testing.T) {
+	useFNV(t)
+	for name, algorithm := range map[string]ChecksumAlgorithm{
+		"built in":   ChecksumCastagnoli,
+		"none":       ChecksumNone,
+		"registered": checksumFNV,
+	} {
+		err := RegisterChecksum(algorithm, fnvChecksum)
+		if !errors.Is(err, ErrInvalidChecksum) {
+			t.Fatalf("%s: err = %v, want ErrInvalidChecksum", name, err)
+		}
+	}
+	err := RegisterChecksum(checksumFNV+1, nil)
+	if !errors.Is(err, ErrInvalidChecksum) {
+		t.Fatalf("nil sum: err = %v, want ErrInvalidChecksum", err)
+	}
+	_, err = NewWithOptions(t.TempDir(), WithChecksum(checksumFNV+1))
+	if err != ErrUnknownChecksum {
+		t.Fatalf("unregistered algorithm: err = %v, want ErrUnknownChecksum", err)
+	}
+}
+
+func TestChecksumChangeStartsNewSegment(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir, WithChecksum(ChecksumIEEE))
+	_, err := w.Write([]byte("ieee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, dir, WithChecksum(ChecksumCastagnoli))
+	_, err = w.Write([]byte("castagnoli"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("got %d segments, want one per algorithm", len(segments))
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each segment is verified with the algorithm it was written with.
+	w = openWAL(t, dir, WithChecksum(ChecksumIEEE), WithRecoveryMode(RecoveryStrict))
+	records := recoverAll(t, w)
+	if fmt.Sprint(records) != "[ieee castagnoli]" {
+		t.Fatalf("records = %q, want [ieee castagnoli]", records)
+	}
+}
+
+func TestDecodeSegmentReadsWrittenSegment(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	writeNumbered(t, w, 5)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(w.CurrentSegment())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []string
+	err = DecodeSegment(bytes.NewReader(data), func(offset uint64, data []byte) error {
+		if offset != uint64(len(records)) {
+			t.Fatalf("offset = %d, want %d", offset, len(records))
+		}
+		records = append(records, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(records) != "[0 1 2 3 4]" {
+		t.Fatalf("records = %q, want [0 1 2 3 4]", records)
+	}
+}
+
+func TestRecoverSkipsSegmentsCutShortByCrash(t *testing.T) {
+	for name, size := range map[string]int{"empty": 0, "partial magic": 2, "partial header": segmentHeaderSize + 3} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := openWAL(t, dir)
+			writeNumbered(t, w, 3)
+			err := w.Rotate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			crashed := w.CurrentSegment()
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A crash right after creating the segment leaves at most part
+			// of its header.
+			data, err := os.ReadFile(crashed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(crashed, data[:size], 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w = openWAL(t, dir)
+			if records := recoverAll(t, w); fmt.Sprint(records) != "[0 1 2]" {
+				t.Fatalf("records = %q, want 0 to 2", records)
+			}
+			report, err := w.Verify()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !report.OK() {
+				t.Fatalf("Verify reported %+v", report)
+			}
+			writeNumbered(t, w, 2)
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w = openWAL(t, dir)
+			if records := recoverAll(t, w); fmt.Sprint(records) != "[0 1 2 0 1]" {
+				t.Fatalf("records after more writes = %q", records)
+			}
+		})
+	}
+}
+
+// encodeLegacySegment frames payloads, at offsets from 0, as a segment of
+// an older format version would, with IEEE checksums. Version 1 segments
+// are written without a header, as before headers existed.
+func encodeLegacySegment(version byte, payloads ...string) []byte {
+	var segment []byte
+	if version > 1 {
+		header := make([]byte, segmentHeaderSize, segmentHeaderSize+createdAtSize)
+		copy(header, segmentMagic)
+		header[4] = version
+		header[5] = byte(ChecksumIEEE)
+		if version >= 4 {
+			header = binary.LittleEndian.AppendUint64(header, uint64(time.Now().UnixNano()))
+		}
+		segment = header
+	}
+	for i, payload := range payloads {
+		header := make([]byte, recordHeaderSize(version))
+		binary.LittleEndian.PutUint64(header[0:8], uint64(i))
+		binary.LittleEndian.PutUint32(header[8:12], uint32(len(payload)))
+		binary.LittleEndian.PutUint32(header[12:16], recordChecksum(ieeeChecksummer, header, []byte(payload)))
+		segment = append(segment, header...)
+		segment = append(segment, payload...)
+		if recordTrailerSize(version) > 0 {
+			segment = append(segment, '\n')
+		}
+	}
+	return segment
+}
+
+func TestRecoverOlderFormats(t *testing.T) {
+	for version := byte(1); version <= segmentVersion; version++ {
+		t.Run(fmt.Sprint("version ", version), func(t *testing.T) {
+			dir := t.TempDir()
+			// Payloads ending in newlines mustn't be confused with the
+			// trailer older versions put after each record.
+			segment := encodeLegacySegment(version, "a", "b\n", "")
+			err := os.WriteFile(filepath.Join(dir, filePrefix+fmt.Sprintf("%020d", 1)), segment, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := openWAL(t, dir)
+			offset, err := w.Write([]byte("new"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != 3 {
+				t.Fatalf("offset = %d, want 3", offset)
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w = openWAL(t, dir)
+			if records := recoverAll(t, w); fmt.Sprintf("%q", records) != `["a" "b\n" "" "new"]` {
+				t.Fatalf("records = %q", records)
+			}
+		})
+	}
+}
+
+func TestCurrentFormatHasNoRecordTrailer(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	_, err := w.Write([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := readSegmentFiles(t, dir)
+	if int64(len(data)) != segmentHeaderSize+createdAtSize+encodedSize(3) || !bytes.HasSuffix(data, []byte("abc")) {
+		t.Fatalf("segment = %q, want the header and one record ending in its payload", data)
+	}
+}
+
+func TestUnsupportedSegmentFormats(t *testing.T) {
+	future := encodeLegacySegment(4, "a")
+	future[4] = segmentVersion + 1
+	for name, segment := range map[string][]byte{
+		"future version": future,
+		"zero version":   append([]byte("TWAL\x00"), make([]byte, 11)...),
+		"garbage":        []byte("garbage that was never a segment"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			// A section reader lets DecodeSegment tell garbage from a
+			// segment written before headers existed.
+			err := DecodeSegment(io.NewSectionReader(bytes.NewReader(segment), 0, int64(len(segment))), func(uint64, []byte) error {
+				return nil
+			})
+			if !errors.Is(err, ErrUnsupportedFormat) {
+				t.Fatalf("DecodeSegment: err = %v, want ErrUnsupportedFormat", err)
+			}
+			dir := t.TempDir()
+			err = os.WriteFile(filepath.Join(dir, filePrefix+fmt.Sprintf("%020d", 1)), segment, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = NewWithOptions(dir)
+			if !errors.Is(err, ErrUnsupportedFormat) {
+				t.Fatalf("New: err = %v, want ErrUnsupportedFormat", err)
+			}
+		})
+	}
+}
+
+func TestCurrentFormatHeader(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	writeNumbered(t, w, 2)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := readSegmentFiles(t, dir)
+	if string(data[:4]) != segmentMagic || data[4] != segmentVersion {
+		t.Fatalf("header = %q, want magic and version %d", data[:segmentHeaderSize], segmentVersion)
+	}
+	var records []string
+	err = DecodeSegment(bytes.NewReader(data), func(_ uint64, data []byte) error {
+		records = append(records, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(records) != "[0 1]" {
+		t.Fatalf("records = %q, want [0 1]", records)
+	}
+}
+
+func TestRecoverStopsAtZeroPadding(t *testing.T) {
+	for name, checksum := range map[string]ChecksumAlgorithm{"ieee": ChecksumIEEE, "none": ChecksumNone} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := openWAL(t, dir, WithChecksum(checksum))
+			// An empty record at offset 0 is mostly zeros itself.
+			for _, data := range []string{"", "a", "b"} {
+				_, err := w.Write([]byte(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			segment := w.CurrentSegment()
+			err := w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = file.Write(make([]byte, 4096))
+			file.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w = openWAL(t, dir, WithChecksum(checksum))
+			var records []string
+			result, err := w.RecoverWithStats(func(data []byte) error {
+				records = append(records, string(data))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprintf("%q", records) != `["" "a" "b"]` || result.Skipped != 0 || result.Corrupted != 0 {
+				t.Fatalf("records = %q, result = %+v; want the three records and nothing skipped", records, result)
+			}
+			// Resuming the segment cuts the padding off before appending.
+			_, err = w.Write([]byte("c"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w = openWAL(t, dir, WithChecksum(checksum))
+			if records := recoverAll(t, w); fmt.Sprintf("%q", records) != `["" "a" "b" "c"]` {
+				t.Fatalf("records after appending = %q", records)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package tinywal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type Stats struct {
+	Segments           int
+	TotalBytes         int64
+	CurrentSegmentSize int64
+	LastSyncTime       time.Time
+	RecordsWritten     uint64
+	CurrentOffset      uint64
+}
+
+// Stats reports a snapshot of the WAL. Segment counts and on-disk sizes are
+// left at zero if the log directory cannot be read.
+func (w *WAL) Stats() Stats {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	stats := Stats{
+		CurrentSegmentSize: w.currentSize,
+		LastSyncTime:       w.lastSyncTime,
+		RecordsWritten:     w.recordsWritten,
+		CurrentOffset:      w.currentOffset,
+	}
+	segmentsWithInfo, err := w.getSortedSegments()
+	if err != nil {
+		return stats
+	}
+	for _, segmentWithInfo := range segmentsWithInfo {
+		size, err := w.storage.Size(segmentWithInfo.Name)
+		if err != nil {
+			continue
+		}
+		stats.Segments += 1
+		stats.TotalBytes += size
+	}
+	return stats
+}
+
+// SegmentMeta describes one segment. FirstOffset and LastOffset are only
+// meaningful when Records is positive. CreatedAt is zero for segments
+// written before creation times were recorded.
+type SegmentMeta struct {
+	Name        string
+	Index       uint64
+	FirstOffset uint64
+	LastOffset  uint64
+	Records     int
+	Size        int64
+	CreatedAt   time.Time
+}
+
+// Segments lists the segments oldest first, reading each one to find its
+// offset range. The listing is taken under the lock, so it is consistent
+// with the writer; segments pruned while they are being read are omitted.
+func (w *WAL) Segments() ([]SegmentMeta, error) {
+	segmentsWithInfo, err := w.snapshotSegments()
+	if err != nil {
+		return nil, err
+	}
+	metas := make([]SegmentMeta, 0, len(segmentsWithInfo))
+	for _, segmentWithInfo := range segmentsWithInfo {
+		size := segmentWithInfo.limit
+		if size <= 0 {
+			size, err = w.storage.Size(segmentWithInfo.Name)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		meta := SegmentMeta{
+			Name:  segmentWithInfo.Name,
+			Index: segmentWithInfo.Index,
+			Size:  size,
+		}
+		scan, err := w.scanSegment(segmentWithInfo, RecoveryLenient, func(record rawRecord) error {
+			if meta.Records == 0 {
+				meta.FirstOffset = record.offset
+			}
+			meta.LastOffset = record.offset
+			meta.Records += 1
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		meta.CreatedAt = scan.created
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+
+// DiskUsage reports the bytes occupied by the WAL's segments. The active
+// segment is counted at its logical size, so records still sitting in the
+// write buffer are included.
+func (w *WAL) DiskUsage() (int64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, ErrWALClosed
+	}
+	segmentsWithInfo, err := w.getSortedSegments()
+	if err != nil {
+		return 0, err
+	}
+	usage := w.currentSize
+	for _, segmentWithInfo := range segmentsWithInfo {
+		if segmentWithInfo.Name == w.currentName {
+			continue
+		}
+		size, err := w.storage.Size(segmentWithInfo.Name)
+		if err != nil {
+			return 0, err
+		}
+		usage += size
+	}
+	return usage, nil
+}
+
+// RecordCount returns the number of offsets from the oldest retained record
+// through the newest, without scanning the log. Offsets are contiguous, so
+// this counts every record still stored, including any later found to be
+// corrupt, and drops as retention or truncation removes segments.
+func (w *WAL) RecordCount() (uint64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, ErrWALClosed
+	}
+	if w.readOnly {
+		// Pick up records appended by the writer since the last call.
+		err := w.restoreOffset()
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		err := w.flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+	segmentsWithInfo, err := w.getSortedSegments()
+	if err != nil {
+		return 0, err
+	}
+	first, ok, err := w.firstOffsetOf(segmentsWithInfo)
+	if err != nil {
+		return 0, err
+	}
+	if !ok || first >= w.currentOffset {
+		return 0, nil
+	}
+	return w.currentOffset - first, nil
+}
+
+// CurrentSegment returns the path of the segment being written, or only its
+// name if it is held by a custom Storage. It is empty for a read-only WAL.
+func (w *WAL) CurrentSegment() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	storage, ok := w.storage.(dirStorage)
+	if !ok || w.currentName == "" {
+		return w.currentName
+	}
+	return filepath.Join(storage.dir, w.currentName)
+}
@@ -0,0 +1,170 @@
+package tinywal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatsAfterWritesAndRotation(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(88))
+	for i := 0; i < 5; i++ {
+		_, err := w.Write([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := w.Stats()
+	// The first segment holds four 24-byte records after its 16-byte
+	// header and the second holds one.
+	if stats.Segments != 2 {
+		t.Fatalf("Segments = %d, want 2", stats.Segments)
+	}
+	if stats.CurrentSegmentSize != 40 {
+		t.Fatalf("CurrentSegmentSize = %d, want 40", stats.CurrentSegmentSize)
+	}
+	if stats.RecordsWritten != 5 || stats.CurrentOffset != 5 {
+		t.Fatalf("RecordsWritten = %d, CurrentOffset = %d, want 5 and 5", stats.RecordsWritten, stats.CurrentOffset)
+	}
+	if stats.LastSyncTime.IsZero() {
+		t.Fatal("LastSyncTime is zero after a rotation")
+	}
+	err := w.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := w.Stats(); stats.TotalBytes != 152 {
+		t.Fatalf("TotalBytes = %d, want 152", stats.TotalBytes)
+	}
+}
+
+func TestSegmentsReportRanges(t *testing.T) {
+	clock := newFakeClock()
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(88), WithClock(clock))
+	for i := 0; i < 6; i++ {
+		_, err := w.Write([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SegmentMeta{
+		{Index: 1, FirstOffset: 0, LastOffset: 3, Records: 4, Size: 112},
+		{Index: 2, FirstOffset: 4, LastOffset: 5, Records: 2, Size: 64},
+		{Index: 3, Records: 0, Size: 16},
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("got %d segments, want %d", len(segments), len(want))
+	}
+	for i, segment := range segments {
+		if segment.Name == "" || !segment.CreatedAt.Equal(clock.Now()) {
+			t.Fatalf("segment %d = %+v, want a name and the fake creation time", i, segment)
+		}
+		segment.Name = ""
+		segment.CreatedAt = want[i].CreatedAt
+		if segment != want[i] {
+			t.Fatalf("segment %d = %+v, want %+v", i, segment, want[i])
+		}
+	}
+}
+
+func TestDiskUsageCountsBufferedRecords(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir, WithSegmentSize(100), WithMaxSegments(100))
+	for i := 0; i < 10; i++ {
+		_, err := w.Write([]byte("0123456789"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Three 29-byte records fill each segment after its 16-byte header, so
+	// ten records take four segments and the last is still buffered.
+	const want = 4*16 + 10*29
+	used, err := w.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != want {
+		t.Fatalf("DiskUsage = %d, want %d", used, want)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onDisk := len(readSegmentFiles(t, dir)); onDisk != want {
+		t.Fatalf("%d bytes on disk after close, want %d", onDisk, want)
+	}
+}
+
+func TestRecordCount(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(88), WithMaxSegments(100))
+	count := func(want uint64) {
+		t.Helper()
+		n, err := w.RecordCount()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("RecordCount = %d, want %d", n, want)
+		}
+	}
+	count(0)
+	// Four records fill a segment, so ten span three.
+	writeNumbered(t, w, 10)
+	count(10)
+	err := w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count(10)
+	// Truncation only removes whole segments, here the one holding 0 to 3.
+	err = w.TruncateBefore(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count(6)
+	writeNumbered(t, w, 1)
+	count(7)
+}
+
+func TestCurrentSegmentFollowsRotation(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir, WithSegmentSize(88), WithMaxSegments(100))
+	first := w.CurrentSegment()
+	if filepath.Dir(first) != dir {
+		t.Fatalf("CurrentSegment = %s, want a path in %s", first, dir)
+	}
+	_, err := os.Stat(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := w.CurrentSegment()
+	if second == first {
+		t.Fatal("CurrentSegment unchanged after Rotate")
+	}
+	// The fifth record no longer fits and rotates by size.
+	writeNumbered(t, w, 5)
+	if w.CurrentSegment() == second {
+		t.Fatal("CurrentSegment unchanged after a size-triggered rotation")
+	}
+
+	reader, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if segment := reader.CurrentSegment(); segment != "" {
+		t.Fatalf("read-only CurrentSegment = %q, want empty", segment)
+	}
+}
@@ -0,0 +1,301 @@
+package tinywal
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Storage holds segment files. Missing files must be reported with errors
+// matching fs.ErrNotExist. The default stores segments in Config.LogDir.
+type Storage interface {
+	// Create opens name for appending, creating it if it doesn't exist.
+	Create(name string) (File, error)
+	// Open opens name for reading.
+	Open(name string) (File, error)
+	Remove(name string) error
+	// Rename atomically replaces newName, if it exists, with oldName.
+	Rename(oldName, newName string) error
+	Truncate(name string, size int64) error
+	Size(name string) (int64, error)
+	// List returns the names of the files in storage, excluding directories.
+	List() ([]string, error)
+	// Sync makes earlier creations, removals and renames durable.
+	Sync() error
+}
+
+// File is an open segment. Writes always append.
+type File interface {
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Sync() error
+	Size() (int64, error)
+}
+
+const (
+	defaultFileMode os.FileMode = 0666
+	defaultDirMode  os.FileMode = 0755
+)
+
+type dirStorage struct {
+	dir      string
+	fileMode os.FileMode
+}
+
+func (s dirStorage) Create(name string) (File, error) {
+	mode := s.fileMode
+	if mode == 0 {
+		mode = defaultFileMode
+	}
+	file, err := os.OpenFile(filepath.Join(s.dir, name), os.O_RDWR|os.O_CREATE|os.O_APPEND, mode)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{file}, nil
+}
+
+func (s dirStorage) Open(name string) (File, error) {
+	file, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return osFile{file}, nil
+}
+
+func (s dirStorage) Remove(name string) error {
+	return os.Remove(filepath.Join(s.dir, name))
+}
+
+func (s dirStorage) Rename(oldName, newName string) error {
+	return os.Rename(filepath.Join(s.dir, oldName), filepath.Join(s.dir, newName))
+}
+
+func (s dirStorage) Truncate(name string, size int64) error {
+	return os.Truncate(filepath.Join(s.dir, name), size)
+}
+
+func (s dirStorage) Size(name string) (int64, error) {
+	fileInfo, err := os.Stat(filepath.Join(s.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), nil
+}
+
+func (s dirStorage) List() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// Sync fsyncs the directory itself, which is what persists the entries of
+// created and removed segments.
+func (s dirStorage) Sync() error {
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Size() (int64, error) {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), nil
+}
+
+// NewMemoryStorage returns a Storage that keeps segments in memory, which
+// is useful for tests. Its contents are lost when it is garbage collected.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{files: make(map[string]*memoryFile)}
+}
+
+type memoryStorage struct {
+	lock  sync.Mutex
+	files map[string]*memoryFile
+}
+
+type memoryFile struct {
+	lock sync.RWMutex
+	data []byte
+}
+
+func (s *memoryStorage) lookup(name string) (*memoryFile, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	file, ok := s.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return file, nil
+}
+
+func (s *memoryStorage) Create(name string) (File, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	file, ok := s.files[name]
+	if !ok {
+		file = &memoryFile{}
+		s.files[name] = file
+	}
+	return &memoryHandle{file: file}, nil
+}
+
+func (s *memoryStorage) Open(name string) (File, error) {
+	file, err := s.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryHandle{file: file, readOnly: true}, nil
+}
+
+func (s *memoryStorage) Remove(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.files[name]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(s.files, name)
+	return nil
+}
+
+func (s *memoryStorage) Rename(oldName, newName string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	file, ok := s.files[oldName]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+	delete(s.files, oldName)
+	s.files[newName] = file
+	return nil
+}
+
+func (s *memoryStorage) Truncate(name string, size int64) error {
+	file, err := s.lookup(name)
+	if err != nil {
+		return err
+	}
+	file.lock.Lock()
+	defer file.lock.Unlock()
+	if size < int64(len(file.data)) {
+		file.data = file.data[:size]
+	}
+	return nil
+}
+
+func (s *memoryStorage) Size(name string) (int64, error) {
+	file, err := s.lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return file.size(), nil
+}
+
+func (s *memoryStorage) List() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *memoryStorage) Sync() error {
+	return nil
+}
+
+func (f *memoryFile) size() int64 {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return int64(len(f.data))
+}
+
+// memoryHandle is an open memoryFile. Like an OS file it keeps working
+// after the file is removed from storage.
+type memoryHandle struct {
+	file     *memoryFile
+	readOnly bool
+	closed   bool
+}
+
+var errFileClosed = errors.New("file already closed")
+
+func (h *memoryHandle) ReadAt(p []byte, off int64) (int, error) {
+	if h.closed {
+		return 0, errFileClosed
+	}
+	h.file.lock.RLock()
+	defer h.file.lock.RUnlock()
+	if off >= int64(len(h.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.file.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *memoryHandle) Write(p []byte) (int, error) {
+	if h.closed {
+		return 0, errFileClosed
+	}
+	if h.readOnly {
+		return 0, fs.ErrPermission
+	}
+	h.file.lock.Lock()
+	defer h.file.lock.Unlock()
+	h.file.data = append(h.file.data, p...)
+	return len(p), nil
+}
+
+func (h *memoryHandle) Sync() error {
+	if h.closed {
+		return errFileClosed
+	}
+	return nil
+}
+
+func (h *memoryHandle) Size() (int64, error) {
+	if h.closed {
+		return 0, errFileClosed
+	}
+	return h.file.size(), nil
+}
+
+func (h *memoryHandle) Close() error {
+	if h.closed {
+		return errFileClosed
+	}
+	h.closed = true
+	return nil
+}
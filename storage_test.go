@@ -0,0 +1,188 @@
+package tinywal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// forEachStorage runs test against a log directory and against memory
+// storage. Every call to open opens the same WAL again.
+func forEachStorage(t *testing.T, test func(t *testing.T, open func(opts ...Option) *WAL)) {
+	t.Run("dir", func(t *testing.T) {
+		dir := t.TempDir()
+		test(t, func(opts ...Option) *WAL {
+			return openWAL(t, dir, opts...)
+		})
+	})
+	t.Run("memory", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		test(t, func(opts ...Option) *WAL {
+			return openWAL(t, "", append([]Option{WithStorage(storage)}, opts...)...)
+		})
+	})
+}
+
+func TestStoragesRecoverAfterReopen(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, open func(opts ...Option) *WAL) {
+		w := open(WithSegmentSize(64), WithMaxSegments(100))
+		writeNumbered(t, w, 10)
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = open(WithSegmentSize(64), WithMaxSegments(100))
+		if records := recoverAll(t, w); fmt.Sprint(records) != "[0 1 2 3 4 5 6 7 8 9]" {
+			t.Fatalf("records = %q, want 0 to 9", records)
+		}
+		offset, err := w.Write([]byte("10"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != 10 {
+			t.Fatalf("offset = %d, want 10", offset)
+		}
+	})
+}
+
+func TestStoragesApplyRetention(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, open func(opts ...Option) *WAL) {
+		w := open(WithSegmentSize(64), WithMaxSegments(2))
+		writeNumbered(t, w, 20)
+		waitForPrune(t, w)
+		if n := w.Stats().Segments; n != 2 {
+			t.Fatalf("%d segments, want 2", n)
+		}
+		records := recoverAll(t, w)
+		if len(records) == 0 || records[len(records)-1] != "19" {
+			t.Fatalf("records = %q, want the newest ones", records)
+		}
+	})
+}
+
+func TestMemoryStorageReportsMissingFiles(t *testing.T) {
+	storage := NewMemoryStorage()
+	_, err := storage.Open("missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Open err = %v, want fs.ErrNotExist", err)
+	}
+	err = storage.Remove("missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Remove err = %v, want fs.ErrNotExist", err)
+	}
+	_, err = storage.Size("missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Size err = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestMemoryHandleKeepsWorkingAfterRemove(t *testing.T) {
+	storage := NewMemoryStorage()
+	file, err := storage.Create("segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Remove("segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_, err = file.ReadAt(buf, 0)
+	if err != nil || string(buf) != "data" {
+		t.Fatalf("ReadAt = %q, %v; want data", buf, err)
+	}
+	err = file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte("more"))
+	if err == nil {
+		t.Fatal("write to a closed handle succeeded")
+	}
+}
+
+func TestFileAndDirModes(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	w := openWAL(t, dir, WithFileMode(0600), WithDirMode(0700), WithSegmentSize(64))
+	writeNumbered(t, w, 10)
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0700 {
+		t.Fatalf("dir mode = %v, want 0700", mode)
+	}
+	names, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) < 2 {
+		t.Fatalf("%d segments, want a rotation", len(names))
+	}
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Fatalf("%s mode = %v, want 0600", filepath.Base(name), mode)
+		}
+	}
+}
+
+func TestSegmentChangesSyncStorage(t *testing.T) {
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithSegmentSize(88), WithMaxSegments(2))
+	created := storage.storageSyncs()
+	if created != 1 {
+		t.Fatalf("%d storage syncs after open, want 1", created)
+	}
+	// Five records rotate once, creating a segment; nine rotate twice,
+	// creating one more and removing the oldest.
+	writeNumbered(t, w, 5)
+	if n := storage.storageSyncs(); n != 2 {
+		t.Fatalf("%d storage syncs after a rotation, want 2", n)
+	}
+	writeNumbered(t, w, 4)
+	waitForPrune(t, w)
+	if n := storage.storageSyncs(); n != 4 {
+		t.Fatalf("%d storage syncs after a rotation and removal, want 4", n)
+	}
+	// Purge creates a segment before removing the old ones, and syncs
+	// after each.
+	err := w.Purge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := storage.storageSyncs(); n != 6 {
+		t.Fatalf("%d storage syncs after a purge, want 6", n)
+	}
+
+	storage = newTestStorage()
+	w = openWAL(t, "", WithStorage(storage), WithSegmentSize(88), WithMaxSegments(2), WithFsync(false))
+	writeNumbered(t, w, 9)
+	waitForPrune(t, w)
+	if n := storage.storageSyncs(); n != 0 {
+		t.Fatalf("%d storage syncs with fsync disabled, want 0", n)
+	}
+}
+
+func TestDirStorageSync(t *testing.T) {
+	storage := dirStorage{dir: t.TempDir()}
+	err := storage.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.dir = filepath.Join(storage.dir, "missing")
+	err = storage.Sync()
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("err = %v, want fs.ErrNotExist", err)
+	}
+}
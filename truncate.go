@@ -0,0 +1,117 @@
+package tinywal
+
+import (
+	"errors"
+	"os"
+)
+
+// TruncateBefore removes the oldest segments whose records all have offsets
+// below the given offset. The active segment is never removed, so records
+// from offset onwards stay available to RecoverFrom.
+func (w *WAL) TruncateBefore(offset uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	err := w.writable()
+	if err != nil {
+		return err
+	}
+	err = w.flush()
+	if err != nil {
+		return err
+	}
+	segmentsWithInfo, err := w.getSortedSegments()
+	if err != nil {
+		return err
+	}
+	for i, segmentWithInfo := range segmentsWithInfo {
+		if !w.removable(segmentWithInfo) {
+			break
+		}
+		nextOffset, ok, err := w.firstOffsetOf(segmentsWithInfo[i+1:])
+		if err != nil {
+			return err
+		}
+		if !ok || nextOffset > offset {
+			break
+		}
+		err = w.removeSegment(segmentWithInfo)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Purge drops every record, removing all segment files and starting over at
+// offset 0 in a fresh segment. Other files in the log directory are left
+// alone. Buffered records that haven't been synced are discarded. If Purge
+// fails the WAL stays usable, writing on from the offset it had reached,
+// though some older segments may already be gone.
+func (w *WAL) Purge() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	err := w.writable()
+	if err != nil {
+		return err
+	}
+	segmentsWithInfo, err := w.getSortedSegments()
+	if err != nil {
+		return err
+	}
+	// The segment index keeps increasing so a reader still holding a
+	// snapshot never mistakes the new segment for one it already listed.
+	purgedLog := w.currentLog
+	purgedName := w.currentName
+	err = w.createNewLogFile()
+	if err != nil {
+		return err
+	}
+	err = purgedLog.Close()
+	if err != nil {
+		w.logger.Warn("closing purged segment failed", "segment", purgedName, "error", err)
+	}
+	for _, segmentWithInfo := range segmentsWithInfo {
+		w.index.drop(segmentWithInfo.Index)
+		err = w.storage.Remove(segmentWithInfo.Name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	// Otherwise a crash could bring purged segments back beside the new
+	// one, whose offsets start again at 0.
+	err = w.syncStorage()
+	if err != nil {
+		return err
+	}
+	w.index.reset()
+	w.currentOffset = 0
+	w.ackedOffset = 0
+	w.readOffset = 0
+	w.hasReadOffset = false
+	return nil
+}
+
+// SetReadOffset records that every record up to and including offset has
+// been consumed. Retention pruning will not delete segments holding records
+// past this watermark and reports ErrRetentionBlocked through
+// LastRetentionError instead.
+func (w *WAL) SetReadOffset(offset uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.readOffset = offset
+	w.hasReadOffset = true
+}
+
+// firstOffsetOf returns the first record offset found in segments.
+func (w *WAL) firstOffsetOf(segments []*segmentInfo) (uint64, bool, error) {
+	for _, segmentWithInfo := range segments {
+		offset, ok, err := readFirstOffset(w.storage, segmentWithInfo)
+		if err != nil {
+			return 0, false, err
+		}
+		if ok {
+			return offset, true, nil
+		}
+	}
+	return 0, false, nil
+}
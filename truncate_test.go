@@ -0,0 +1,179 @@
+package tinywal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeNumbered writes the records "0" to "n-1".
+func writeNumbered(t *testing.T, w *WAL, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := w.Write([]byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTruncateBeforeKeepsReplayPoint(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(100))
+	writeNumbered(t, w, 50)
+	before, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.TruncateBefore(25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) >= len(before) {
+		t.Fatalf("still %d segments, want fewer than %d", len(after), len(before))
+	}
+	if after[0].FirstOffset > 25 {
+		t.Fatalf("oldest segment starts at %d, past the truncation point", after[0].FirstOffset)
+	}
+	// RecoverFrom takes the last offset already applied.
+	var replayed []string
+	err = w.RecoverFrom(24, func(data []byte) error {
+		replayed = append(replayed, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 25 || replayed[0] != "25" {
+		t.Fatalf("replayed %q, want 25 to 49", replayed)
+	}
+}
+
+func TestTruncateBeforeKeepsActiveSegment(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(100))
+	writeNumbered(t, w, 10)
+	err := w.TruncateBefore(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 || segments[0].Name != w.CurrentSegment() {
+		t.Fatalf("segments = %+v, want only the active one", segments)
+	}
+	offset, err := w.Write([]byte("next"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 10 {
+		t.Fatalf("offset = %d, want 10", offset)
+	}
+}
+
+func TestRetentionBlockedByReadOffset(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(2))
+	w.SetReadOffset(0)
+	writeNumbered(t, w, 20)
+	waitForPrune(t, w)
+	if err := w.LastRetentionError(); !errors.Is(err, ErrRetentionBlocked) {
+		t.Fatalf("LastRetentionError = %v, want ErrRetentionBlocked", err)
+	}
+	if n := len(recoverAll(t, w)); n != 20 {
+		t.Fatalf("recovered %d records, want all 20 kept for the reader", n)
+	}
+}
+
+func TestRetentionUnblockedByReadOffset(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(2))
+	for i := 0; i < 20; i++ {
+		offset, err := w.Write([]byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.SetReadOffset(offset)
+	}
+	waitForPrune(t, w)
+	if err := w.LastRetentionError(); err != nil {
+		t.Fatalf("LastRetentionError = %v, want nil", err)
+	}
+	segments, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) > 2 {
+		t.Fatalf("got %d segments, want at most 2", len(segments))
+	}
+}
+
+func TestPurge(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "README.txt"), []byte("keep me"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := openWAL(t, dir, WithSegmentSize(64), WithMaxSegments(100))
+	writeNumbered(t, w, 10)
+	err = w.Purge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := recoverAll(t, w); len(records) != 0 {
+		t.Fatalf("records = %q after Purge, want none", records)
+	}
+	offset, err := w.Write([]byte("fresh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 0 {
+		t.Fatalf("offset = %d, want 0", offset)
+	}
+	_, err = os.Stat(filepath.Join(dir, "README.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, dir)
+	if records := recoverAll(t, w); fmt.Sprint(records) != "[fresh]" {
+		t.Fatalf("records = %q after reopening, want [fresh]", records)
+	}
+}
+
+func TestPurgeFailureLeavesWALUsable(t *testing.T) {
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage))
+	writeNumbered(t, w, 3)
+	err := w.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	injected := errors.New("injected remove failure")
+	storage.failRemoves(injected)
+	err = w.Purge()
+	if !errors.Is(err, injected) {
+		t.Fatalf("err = %v, want the injected error", err)
+	}
+	storage.failRemoves(nil)
+	offset, err := w.Write([]byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 3 {
+		t.Fatalf("offset = %d, want 3", offset)
+	}
+	if records := recoverAll(t, w); fmt.Sprint(records) != "[0 1 2 3]" {
+		t.Fatalf("records = %q, want [0 1 2 3]", records)
+	}
+	if n := storage.openWriters(); n != 1 {
+		t.Fatalf("%d segment handles open, want 1", n)
+	}
+}
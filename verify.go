@@ -0,0 +1,60 @@
+package tinywal
+
+type SegmentReport struct {
+	Name    string
+	Index   uint64
+	Records int
+	// CorruptPositions holds the byte position of each record in the
+	// segment that failed validation.
+	CorruptPositions []int64
+	// Torn is set when the segment ends in a partially written record.
+	Torn bool
+}
+
+type VerifyReport struct {
+	Segments  []SegmentReport
+	Records   int
+	Corrupted int
+}
+
+func (r VerifyReport) OK() bool {
+	if r.Corrupted > 0 {
+		return false
+	}
+	for _, segment := range r.Segments {
+		if segment.Torn {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify checks the framing and checksum of every record in every segment
+// without decoding payloads. Corruption is reported, not returned as an
+// error, and it can run while writes continue.
+func (w *WAL) Verify() (VerifyReport, error) {
+	var report VerifyReport
+	segmentsWithInfo, err := w.snapshotSegments()
+	if err != nil {
+		return report, err
+	}
+	for _, segmentWithInfo := range segmentsWithInfo {
+		segmentReport := SegmentReport{
+			Name:  segmentWithInfo.Name,
+			Index: segmentWithInfo.Index,
+		}
+		scan, err := w.scanSegment(segmentWithInfo, RecoveryLenient, func(record rawRecord) error {
+			segmentReport.Records += 1
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+		segmentReport.CorruptPositions = scan.corruptAt
+		segmentReport.Torn = scan.torn
+		report.Segments = append(report.Segments, segmentReport)
+		report.Records += segmentReport.Records
+		report.Corrupted += scan.corrupted
+	}
+	return report, nil
+}
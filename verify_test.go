@@ -0,0 +1,39 @@
+package tinywal
+
+import "testing"
+
+func TestVerifyCleanWAL(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(100))
+	writeNumbered(t, w, 10)
+	report, err := w.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Records != 10 || len(report.Segments) < 2 {
+		t.Fatalf("report = %+v, want 10 clean records over several segments", report)
+	}
+}
+
+func TestVerifyReportsCorruption(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	writeNumbered(t, w, 5)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptSegment(t, dir, 2, recordHeaderSize(segmentVersion))
+	w = openWAL(t, dir)
+	report, err := w.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || report.Records != 4 || report.Corrupted != 1 {
+		t.Fatalf("report = %+v, want 4 records and 1 corrupted", report)
+	}
+	want := segmentHeaderSize + createdAtSize + 2*encodedSize(1)
+	positions := report.Segments[0].CorruptPositions
+	if len(positions) != 1 || positions[0] != want {
+		t.Fatalf("corrupt positions = %v, want [%d]", positions, want)
+	}
+}
@@ -1,18 +1,20 @@
 package tinywal
 
 import (
-	"bufio"
-	"encoding/binary"
+	"context"
 	"errors"
-	"hash/crc32"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unsafe"
 )
 
 const (
@@ -20,177 +22,1133 @@ const (
 )
 
 var (
-	ErrBytesLength        = errors.New("line less than expected")
-	ErrChecksumValidation = errors.New("checksum mismatch")
+	ErrBytesLength         = errors.New("line less than expected")
+	ErrChecksumValidation  = errors.New("checksum mismatch")
+	ErrLogDirNotDirectory  = errors.New("log dir is not a directory")
+	ErrEmptyLogDir         = errors.New("log dir must not be empty")
+	ErrInvalidSegmentSize  = errors.New("segment size must be positive")
+	ErrInvalidMaxSegments  = errors.New("max segments must be positive")
+	ErrInvalidSyncPeriod   = errors.New("sync time period must be positive")
+	ErrInvalidSyncMode     = errors.New("unknown sync mode")
+	ErrUnknownChecksum     = errors.New("unknown checksum algorithm")
+	ErrInvalidCodec        = errors.New("codec id must be between 1 and 15")
+	ErrUnknownCodec        = errors.New("record compressed with unknown codec")
+	ErrDecryption          = errors.New("record decryption failed")
+	ErrRetentionBlocked    = errors.New("retention would delete unread records")
+	ErrNoEncryptionKey     = errors.New("record is encrypted but no key is configured")
+	ErrSegmentNotFound     = errors.New("segment not found")
+	ErrRecordTooLarge      = errors.New("record exceeds max record size")
+	ErrInvalidRecordSize   = errors.New("max record size must not be negative")
+	ErrDiskFull            = errors.New("disk full")
+	ErrRecordNotFound      = errors.New("record not found")
+	ErrWALClosed           = errors.New("wal is closed")
+	ErrInvalidPrefix       = errors.New("segment prefix must not contain a path separator")
+	ErrReadOnly            = errors.New("wal is read-only")
+	ErrImportOffset        = errors.New("imported record offset is not the next offset")
+	ErrSegmentSizeTooSmall = errors.New("segment size is too small to hold a record")
+	ErrUnsupportedFormat   = errors.New("unsupported segment format")
+	ErrStopRecovery        = errors.New("stop recovery")
+	ErrInvalidBufferSize   = errors.New("buffer size must not be negative")
+	ErrActiveSegment       = errors.New("cannot repair the active segment")
+	ErrInvalidChecksum     = errors.New("checksum algorithm is built in, already registered or nil")
+
+	errStopSegment = errors.New("stop segment")
 )
 
 type Config struct {
-	LogDir         string
+	LogDir string
+	// SegmentSize is the size beyond which the active segment is rotated.
+	// It must leave room for the segment header and a record of
+	// MaxRecordSize bytes.
 	SegmentSize    int64
 	MaxSegments    int
 	SyncTimePeriod time.Duration
+	// MaxTotalBytes, when positive, also prunes the oldest segments until
+	// the WAL's on-disk size fits the budget. The active segment is never
+	// pruned, so a single oversized segment can exceed it.
+	MaxTotalBytes int64
+	// NoRetention keeps every segment forever, for logs such as audit
+	// trails that must never lose records. MaxSegments and MaxTotalBytes are
+	// then ignored, and MaxSegments may be zero. Segments are still removed
+	// by explicit calls such as TruncateBefore and Purge.
+	NoRetention bool
+	// SyncMode chooses when buffered records reach disk. SyncInterval (the
+	// default) syncs every SyncTimePeriod, so a crash loses at most one
+	// period of writes. SyncAlways syncs before every Write returns, which
+	// is the safest and slowest. SyncNever only syncs on rotation, Close or
+	// an explicit Sync call, and SyncTimePeriod is ignored.
+	SyncMode SyncMode
+	// SyncErrors, when set, receives background sync failures. Sends never
+	// block; errors are dropped if the channel is full.
+	SyncErrors chan<- error
+	// DisableFsync skips the fsync in Sync and of the log directory after
+	// segments are created or removed, trading power-loss durability for
+	// throughput. Flushed data still survives a process crash. WriteSync and
+	// Drain fsync regardless.
+	DisableFsync bool
+	// TruncateTornTail cuts a partially written final record, left by a
+	// crash mid-write, off the newest segment when the WAL is opened.
+	TruncateTornTail bool
+	// AllowRepair lets RepairSegment truncate segments of a WAL opened with
+	// OpenReadOnly, which otherwise never modifies files. Only use it while
+	// no writer has the WAL open.
+	AllowRepair bool
+	// RecoveryMode decides what reads do with a record that fails checksum
+	// validation: RecoveryLenient (the default) skips it and resynchronizes
+	// on the next intact record, RecoveryStrict stops with
+	// ErrChecksumValidation.
+	RecoveryMode RecoveryMode
+	// Checksum selects the algorithm used for new records: a built-in one or
+	// one added with RegisterChecksum. Segments record the algorithm they
+	// were written with, so recovery always verifies against the right one.
+	Checksum ChecksumAlgorithm
+	// Compression, when set, compresses each payload that shrinks under the
+	// codec. Records that don't benefit are stored raw.
+	Compression Codec
+	// EncryptionKey, when set, seals each payload with AES-GCM. It must be
+	// 16, 24 or 32 bytes long.
+	EncryptionKey []byte
+	// MaxRecordSize caps the payload length Write accepts, returning
+	// ErrRecordTooLarge beyond it. Zero means the largest payload that fits
+	// in a segment along with its header and framing.
+	MaxRecordSize int64
+	// IndexInterval, when positive, keeps an in-memory index with an entry
+	// every IndexInterval records, so Get and RecoverFrom seek close to the
+	// requested offset instead of scanning its whole segment.
+	IndexInterval int
+	// Clock, when set, replaces the system clock for sync timestamps and the
+	// background sync ticker.
+	Clock Clock
+	// Storage, when set, holds the segments instead of LogDir, which may then
+	// be left empty.
+	Storage Storage
+	// MaxSegmentAge, when positive, rotates a segment once its first record
+	// is older than this, so quiet logs still roll over and age out. The
+	// check runs on each write and, with SyncInterval, on every background
+	// sync.
+	MaxSegmentAge time.Duration
+	// OnRotate, when set, is called with each segment sealed by a rotation.
+	// Calls happen in order on a separate goroutine, so the callback may do
+	// slow work such as archiving the file, though retention may already
+	// have removed the segment by then. Its errors are logged and sent to
+	// SyncErrors.
+	OnRotate func(sealed SegmentMeta) error
+	// FileMode and DirMode set the permissions, before the umask, of new
+	// segment files and of LogDir if New creates it. Zero means 0666 and
+	// 0755. They don't apply to a custom Storage.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+	// Prefix names this WAL's segment files, which defaults to "segment-".
+	// WALs sharing a directory with different prefixes ignore each other's
+	// segments.
+	Prefix string
+	// Logger receives corruption, torn-tail and background error events.
+	// Nothing is logged when it is nil.
+	Logger *slog.Logger
+	// BufferSize sets the bytes buffered before writes reach the active
+	// segment, which also forces a flush once it fills. Zero means 4096.
+	BufferSize int
+	// Preallocate reserves SegmentSize bytes of disk for each new segment
+	// on Linux, so writes don't stall on block allocation. The file size
+	// still tracks the records written. It does nothing elsewhere.
+	Preallocate bool
 }
 
+type SyncMode int
+
+const (
+	SyncInterval SyncMode = iota
+	SyncAlways
+	SyncNever
+)
+
+type RecoveryMode int
+
+const (
+	RecoveryLenient RecoveryMode = iota
+	RecoveryStrict
+)
+
+// WAL is safe for concurrent use. The fields above lock are set by New and
+// never change; lock guards everything below it, including the contents of
+// the active segment, which readers only see through snapshotSegments.
 type WAL struct {
-	logDir         string
-	currentLog     *os.File
-	bufWriter      *bufio.Writer
-	maxSegments    int
-	segmentSize    int64
-	lock           sync.Mutex
-	syncTimeTicker *time.Ticker
-	currentOffset  int64
+	storage          Storage
+	prefix           string
+	maxSegments      int
+	maxTotalBytes    int64
+	noRetention      bool
+	segmentSize      int64
+	maxRecordSize    int64
+	maxSegmentAge    time.Duration
+	syncMode         SyncMode
+	syncTimeTicker   Ticker
+	syncErrors       chan<- error
+	clock            Clock
+	disableFsync     bool
+	truncateTornTail bool
+	allowRepair      bool
+	recoveryMode     RecoveryMode
+	checksum         ChecksumAlgorithm
+	encoder          *RecordEncoder
+	rotateHook       *rotateHook
+	logger           *slog.Logger
+	bufferSize       int
+	preallocate      bool
+	readOnly         bool
+	payload          *payloadCodec
+	done             chan struct{}
+	pruneWake        chan struct{}
+	wg               sync.WaitGroup
+
+	lock             sync.Mutex
+	closed           bool
+	currentLog       File
+	currentName      string
+	bufWriter        *segmentWriter
+	currentOffset    uint64
+	currentSize      int64
+	segmentIndex     uint64
+	segmentStarted   time.Time
+	segmentCreated   time.Time
+	segmentRecords   int
+	segmentFirst     uint64
+	ackedSize        int64
+	ackedOffset      uint64
+	ackedRecords     int
+	dirtyTail        bool
+	recordsWritten   uint64
+	lastSyncTime     time.Time
+	lastSyncErr      error
+	lastRetentionErr error
+	prunePending     bool
+	readOffset       uint64
+	hasReadOffset    bool
+	writeNotify      chan struct{}
+	syncNotify       chan struct{}
+	index            *offsetIndex
 }
 
 type segmentInfo struct {
-	Name      string
-	Timestamp int64
+	Name  string
+	Index uint64
+	limit int64
+	// start, when set, is the record boundary decoding begins at.
+	start int64
 }
 
 func New(config *Config) (*WAL, error) {
-	err := os.Mkdir(config.LogDir, 0755)
+	return open(config, false)
+}
+
+func open(config *Config, readOnly bool) (*WAL, error) {
+	err := config.validate()
 	if err != nil {
 		return nil, err
 	}
+	recordCipher, err := newRecordCipher(config.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	storage := config.Storage
+	if storage == nil && readOnly {
+		storage = dirStorage{dir: config.LogDir}
+	}
+	if storage == nil {
+		err = createLogDir(config.LogDir, config.DirMode)
+		if err != nil {
+			return nil, err
+		}
+		storage = dirStorage{dir: config.LogDir, fileMode: config.FileMode}
+	}
 	wal := &WAL{
-		logDir:         config.LogDir,
-		maxSegments:    config.MaxSegments,
-		segmentSize:    config.SegmentSize,
-		syncTimeTicker: time.NewTicker(config.SyncTimePeriod),
+		storage:          storage,
+		prefix:           config.Prefix,
+		maxSegments:      config.MaxSegments,
+		maxTotalBytes:    config.MaxTotalBytes,
+		noRetention:      config.NoRetention,
+		segmentSize:      config.SegmentSize,
+		maxRecordSize:    config.MaxRecordSize,
+		maxSegmentAge:    config.MaxSegmentAge,
+		syncMode:         config.SyncMode,
+		syncErrors:       config.SyncErrors,
+		done:             make(chan struct{}),
+		pruneWake:        make(chan struct{}, 1),
+		disableFsync:     config.DisableFsync,
+		truncateTornTail: config.TruncateTornTail,
+		allowRepair:      config.AllowRepair,
+		recoveryMode:     config.RecoveryMode,
+		checksum:         config.Checksum,
+		encoder:          &RecordEncoder{checksums: config.Checksum.checksummer()},
+		index:            newOffsetIndex(config.IndexInterval),
+		clock:            config.Clock,
+		logger:           config.Logger,
+		bufferSize:       config.BufferSize,
+		preallocate:      config.Preallocate,
+		readOnly:         readOnly,
+		payload: &payloadCodec{
+			codec:  config.Compression,
+			cipher: recordCipher,
+		},
+	}
+	if wal.prefix == "" {
+		wal.prefix = filePrefix
+	}
+	if wal.clock == nil {
+		wal.clock = realClock{}
+	}
+	if wal.logger == nil {
+		wal.logger = slog.New(discardHandler{})
+	}
+	wal.rotateHook = newRotateHook(config.OnRotate, wal.logger)
+	if wal.maxRecordSize == 0 {
+		wal.maxRecordSize = config.SegmentSize - minSegmentSize
+	}
+	if !readOnly {
+		err = wal.finishCompaction()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = wal.restoreOffset()
+	if err != nil {
+		return nil, err
 	}
-	err = wal.createNewLogFile()
+	err = wal.buildIndex()
 	if err != nil {
 		return nil, err
 	}
-	go wal.syncInBackground()
+	if readOnly {
+		return wal, nil
+	}
+	err = wal.resumeLogFile()
+	if err != nil {
+		return nil, err
+	}
+	wal.prune()
+	wal.wg.Add(1)
+	go wal.pruneInBackground()
+	if wal.syncMode == SyncInterval {
+		wal.syncTimeTicker = wal.clock.NewTicker(config.SyncTimePeriod)
+		wal.wg.Add(1)
+		go wal.syncInBackground()
+	}
+	if wal.rotateHook != nil {
+		wal.wg.Add(1)
+		go func() {
+			defer wal.wg.Done()
+			wal.rotateHook.run(wal.done, wal.reportSyncError)
+		}()
+	}
 	return wal, nil
 }
 
+func (c *Config) validate() error {
+	if c.LogDir == "" && c.Storage == nil {
+		return ErrEmptyLogDir
+	}
+	if c.SegmentSize <= 0 {
+		return ErrInvalidSegmentSize
+	}
+	if c.SegmentSize < minSegmentSize || c.SegmentSize < segmentSizeFor(c.MaxRecordSize) {
+		return ErrSegmentSizeTooSmall
+	}
+	if strings.ContainsAny(c.Prefix, `/\`) {
+		return ErrInvalidPrefix
+	}
+	if c.MaxRecordSize < 0 {
+		return ErrInvalidRecordSize
+	}
+	if c.BufferSize < 0 {
+		return ErrInvalidBufferSize
+	}
+	if c.MaxSegments <= 0 && !c.NoRetention {
+		return ErrInvalidMaxSegments
+	}
+	if c.SyncMode > SyncNever {
+		return ErrInvalidSyncMode
+	}
+	if c.SyncMode == SyncInterval && c.SyncTimePeriod <= 0 {
+		return ErrInvalidSyncPeriod
+	}
+	if !c.Checksum.known() {
+		return ErrUnknownChecksum
+	}
+	if c.Compression != nil && (c.Compression.ID() == 0 || c.Compression.ID() > codecMask) {
+		return ErrInvalidCodec
+	}
+	return nil
+}
+
+func createLogDir(logDir string, mode os.FileMode) error {
+	info, err := os.Stat(logDir)
+	if err == nil {
+		if !info.IsDir() {
+			return ErrLogDirNotDirectory
+		}
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if mode == 0 {
+		mode = defaultDirMode
+	}
+	return os.MkdirAll(logDir, mode)
+}
+
+// restoreOffset continues the offset sequence after the last valid record
+// on disk. Empty or fully corrupt trailing segments are skipped.
+func (w *WAL) restoreOffset() error {
+	segmentsWithInfo, err := w.getSortedSegments()
+	if err != nil {
+		return err
+	}
+	if len(segmentsWithInfo) > 0 {
+		w.segmentIndex = segmentsWithInfo[len(segmentsWithInfo)-1].Index
+	}
+	for i := len(segmentsWithInfo) - 1; i >= 0; i-- {
+		// RecoveryMode only governs reads. A corrupt record must not stop
+		// the WAL opening, nor hide later offsets that mustn't be reused.
+		scan, err := w.scanSegment(segmentsWithInfo[i], RecoveryLenient, func(rawRecord) error {
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if scan.torn && w.truncateTornTail && !w.readOnly && i == len(segmentsWithInfo)-1 {
+			err = w.storage.Truncate(segmentsWithInfo[i].Name, scan.validSize)
+			if err != nil {
+				return err
+			}
+		}
+		if scan.records > 0 {
+			w.currentOffset = scan.lastOffset + 1
+			return nil
+		}
+	}
+	w.currentOffset = 0
+	return nil
+}
+
+func (w *WAL) segmentName(index uint64) string {
+	return fmt.Sprintf("%s%020d", w.prefix, index)
+}
+
+// resumeLogFile reopens the newest segment for appending, so restarts don't
+// leave a trail of part-filled segments. A new segment is started instead
+// if there is none, or if the newest is full, ends in a torn record, or was
+// written in another format or with another checksum.
+func (w *WAL) resumeLogFile() error {
+	segmentsWithInfo, err := w.getSortedSegments()
+	if err != nil {
+		return err
+	}
+	if len(segmentsWithInfo) == 0 {
+		return w.createNewLogFile()
+	}
+	last := segmentsWithInfo[len(segmentsWithInfo)-1]
+	var first uint64
+	seen := false
+	scan, err := w.scanSegment(last, RecoveryLenient, func(record rawRecord) error {
+		if !seen {
+			first, seen = record.offset, true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	headerCutShort := scan.validSize < segmentHeaderSize+createdAtSize
+	if scan.torn || scan.validSize > w.segmentSize || scan.version != segmentVersion ||
+		(scan.checksum != w.checksum && !headerCutShort) {
+		return w.createNewLogFile()
+	}
+	if headerCutShort {
+		err = w.storage.Truncate(last.Name, 0)
+		if err != nil {
+			return err
+		}
+	}
+	if scan.padded {
+		// New records must follow the last one, not the padding.
+		err = w.storage.Truncate(last.Name, scan.validSize)
+		if err != nil {
+			return err
+		}
+	}
+	w.segmentIndex = last.Index - 1
+	err = w.createNewLogFile()
+	if err != nil {
+		return err
+	}
+	if !headerCutShort {
+		w.segmentCreated = scan.created
+	}
+	w.segmentRecords = scan.records
+	w.ackedRecords = scan.records
+	if scan.records > 0 {
+		w.segmentFirst = first
+		// The first record's time isn't stored, so the segment's age is
+		// counted from its creation.
+		w.segmentStarted = scan.created
+	}
+	return nil
+}
+
+// createNewLogFile makes the next segment the active one. The WAL is left
+// as it was if that fails, so the current segment, if any, stays active.
 func (w *WAL) createNewLogFile() error {
-	timestamp := time.Now().Unix()
-	filePath := w.logDir + "/" + filePrefix + "-" + strconv.FormatInt(timestamp, 10)
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	index := w.segmentIndex + 1
+	name := w.segmentName(index)
+	file, err := w.storage.Create(name)
+	if err != nil {
+		return diskError(err)
+	}
+	size, err := file.Size()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if w.preallocate {
+		err = preallocate(file, w.segmentSize)
+		if err != nil {
+			file.Close()
+			return diskError(err)
+		}
+	}
+	err = w.syncStorage()
 	if err != nil {
+		file.Close()
 		return err
 	}
+	writer := newSegmentWriter(file, w.bufferSize, size)
+	created := time.Time{}
+	if size == 0 {
+		created = w.clock.Now()
+		header := encodeSegmentHeader(w.checksum, created)
+		_, err = writer.Write(header)
+		if err != nil {
+			file.Close()
+			return diskError(err)
+		}
+		size += int64(len(header))
+	}
 	w.currentLog = file
-	w.bufWriter = bufio.NewWriter(file)
-	w.currentOffset = 0
+	w.currentName = name
+	w.bufWriter = writer
+	w.currentSize = size
+	w.segmentIndex = index
+	w.segmentRecords = 0
+	w.segmentCreated = created
+	w.dirtyTail = false
+	w.acknowledge()
 	return nil
 }
 
-func (w *WAL) Write(data []byte) error {
+// Write appends data as a single record and returns its offset. An empty
+// payload is a valid record and is recovered as a non-nil empty slice, so it
+// can be used as a marker. If the record can't be written out, failing with
+// ErrDiskFull if the disk is full, it is dropped and its offset is given to
+// the next record. Records acknowledged by earlier calls are never dropped:
+// whatever a failed flush couldn't write stays buffered and is retried.
+func (w *WAL) Write(data []byte) (uint64, error) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
-	err := w.rotateLogIfSizeExceeds()
+	locator, err := w.writeRecord(0, data)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	_, err = w.currentLog.Seek(0, io.SeekStart)
-	offset := w.currentOffset
+	err = w.commit(w.syncIfAlways)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	return locator.Offset, nil
+}
+
+// WriteSync appends data like Write and then flushes and fsyncs the active
+// segment before returning, whatever the SyncMode and even when fsync is
+// disabled.
+func (w *WAL) WriteSync(data []byte) (uint64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	locator, err := w.writeRecord(0, data)
+	if err != nil {
+		return 0, err
 	}
-	checksum := crc32.ChecksumIEEE(data)
+	err = w.commit(w.fsync)
+	if err != nil {
+		return 0, err
+	}
+	return locator.Offset, nil
+}
 
-	checksumBytes := make([]byte, 4)
-	lenBytes := make([]byte, 4)
-	offsetBytes := make([]byte, 8)
+// WriteString appends s like Write. Without compression it skips copying s
+// into a byte slice.
+func (w *WAL) WriteString(s string) (uint64, error) {
+	if w.payload.codec != nil {
+		// A Codec is user code and could modify the string's memory.
+		return w.Write([]byte(s))
+	}
+	// The write path only reads data, so it can't modify the string.
+	return w.Write(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
 
-	binary.LittleEndian.PutUint64(offsetBytes, uint64(offset))
-	binary.LittleEndian.PutUint32(lenBytes, uint32(len(data)))
-	binary.LittleEndian.PutUint32(checksumBytes, checksum)
+// WriteTyped appends data like Write, tagging the record with an
+// application defined type that RecoverTyped reports back.
+func (w *WAL) WriteTyped(recordType uint16, data []byte) (uint64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	locator, err := w.writeRecord(recordType, data)
+	if err != nil {
+		return 0, err
+	}
+	err = w.commit(w.syncIfAlways)
+	if err != nil {
+		return 0, err
+	}
+	return locator.Offset, nil
+}
 
-	_, err = w.bufWriter.Write(offsetBytes)
+// WriteBatch appends all records under a single lock acquisition and returns
+// the offset of the first one. Offsets within a batch are contiguous. If the
+// batch fails, its records in the active segment are dropped.
+func (w *WAL) WriteBatch(records [][]byte) (uint64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, data := range records {
+		if int64(len(data)) > w.maxRecordSize {
+			return 0, ErrRecordTooLarge
+		}
+	}
+	firstOffset := w.currentOffset
+	for _, data := range records {
+		_, err := w.writeRecord(0, data)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err := w.commit(w.syncIfAlways)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	return firstOffset, nil
+}
 
-	_, err = w.bufWriter.Write(lenBytes)
+func (w *WAL) syncIfAlways() error {
+	if w.syncMode != SyncAlways {
+		return nil
+	}
+	return w.sync()
+}
+
+// commit finishes a write call once its records are appended. If sync fails
+// they are rolled back like a record that couldn't be written; otherwise
+// they are acknowledged and followers are woken.
+func (w *WAL) commit(sync func() error) error {
+	err := sync()
 	if err != nil {
-		return err
+		return w.rollback(err)
 	}
+	w.acknowledge()
+	w.notifyFollowers()
+	return nil
+}
+
+func (w *WAL) writeRecord(recordType uint16, data []byte) (Locator, error) {
+	return w.writeRecordAt(w.currentOffset, recordType, data)
+}
 
-	_, err = w.bufWriter.Write(checksumBytes)
+// writeRecordAt appends a record with the given offset, which must not
+// precede currentOffset, and moves currentOffset past it once it is written.
+// On failure every record since the last acknowledged one is rolled back.
+func (w *WAL) writeRecordAt(offset uint64, recordType uint16, data []byte) (Locator, error) {
+	err := w.writable()
 	if err != nil {
-		return err
+		return Locator{}, err
 	}
+	locator, err := w.appendRecord(offset, recordType, data)
+	if err != nil {
+		return Locator{}, w.rollback(err)
+	}
+	return locator, nil
+}
 
-	_, err = w.bufWriter.Write(data)
+func (w *WAL) appendRecord(offset uint64, recordType uint16, data []byte) (Locator, error) {
+	if int64(len(data)) > w.maxRecordSize {
+		return Locator{}, ErrRecordTooLarge
+	}
+	data, flags, err := w.payload.encode(offset, data)
 	if err != nil {
-		return err
+		return Locator{}, err
+	}
+	// The length field is 4 bytes, and encryption can grow the payload.
+	if uint64(len(data)) > math.MaxUint32 {
+		return Locator{}, ErrRecordTooLarge
+	}
+	err = w.rotateIfNeeded()
+	if err != nil {
+		return Locator{}, err
+	}
+	locator := Locator{
+		Offset:   offset,
+		Segment:  w.segmentIndex,
+		Position: w.currentSize,
+	}
+	err = w.encoder.encodeTo(w.bufWriter, offset, flags, recordType, data)
+	if err != nil {
+		return Locator{}, diskError(err)
 	}
+	w.currentOffset = offset + 1
+	w.recordsWritten += 1
+	if w.segmentRecords == 0 {
+		w.segmentStarted = w.clock.Now()
+		w.segmentFirst = offset
+	}
+	w.segmentRecords += 1
+	w.currentSize += encodedSize(len(data))
+	w.index.add(locator.Segment, offset, locator.Position)
+	return locator, nil
+}
 
-	if _, err := w.bufWriter.Write([]byte("\n")); err != nil {
-		return err
+func (w *WAL) rotateIfNeeded() error {
+	if w.dirtyTail || w.currentSize > w.segmentSize || w.segmentExpired() {
+		return w.rotate()
 	}
-	w.currentOffset += 1
 	return nil
 }
 
-func (w *WAL) rotateLogIfSizeExceeds() error {
-	files, err := w.getAllSegments()
+// segmentExpired reports whether the active segment's first record was
+// written longer than the configured maximum age ago.
+func (w *WAL) segmentExpired() bool {
+	if w.maxSegmentAge <= 0 || w.segmentRecords == 0 {
+		return false
+	}
+	return w.clock.Now().Sub(w.segmentStarted) >= w.maxSegmentAge
+}
+
+// Rotate seals the active segment and starts a new one, regardless of its
+// size. Offsets carry on across the boundary.
+func (w *WAL) Rotate() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	err := w.writable()
 	if err != nil {
 		return err
 	}
-	err = w.processOldSegments(files)
+	return w.rotate()
+}
+
+// rotate seals the active segment and starts the next one. It only switches
+// once the old segment is flushed and synced and the new one is created, so
+// on failure writes carry on in the old segment and a later write retries.
+func (w *WAL) rotate() error {
+	err := w.sync()
 	if err != nil {
 		return err
 	}
-	fileInfo, err := w.currentLog.Stat()
+	sealed := w.sealedSegment()
+	sealedLog := w.currentLog
+	err = w.createNewLogFile()
 	if err != nil {
 		return err
 	}
-	fileSize := fileInfo.Size()
-	if fileSize > w.segmentSize {
-		w.Sync()
-		w.createNewLogFile()
+	err = sealedLog.Close()
+	if err != nil {
+		// The segment is already synced, so its records are safe.
+		w.logger.Warn("closing sealed segment failed", "segment", sealed.Name, "error", err)
 	}
+	w.rotateHook.enqueue(sealed)
+	w.schedulePrune()
 	return nil
 }
 
+// schedulePrune has pruneInBackground apply retention, so removing old
+// segments never holds up or fails the write that rotated.
+func (w *WAL) schedulePrune() {
+	w.prunePending = true
+	select {
+	case w.pruneWake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *WAL) pruneInBackground() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.pruneWake:
+			w.lock.Lock()
+			if w.prunePending && !w.closed {
+				w.prunePending = false
+				w.prune()
+			}
+			w.lock.Unlock()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// prune applies retention. Its failures, such as a segment that can't be
+// removed or ErrRetentionBlocked, are kept for LastRetentionError until a
+// later prune, retried after the next rotation, succeeds.
+func (w *WAL) prune() {
+	err := w.pruneSegments()
+	w.lastRetentionErr = err
+	if err != nil {
+		w.logger.Warn("retention failed", "error", err)
+	}
+}
+
+func (w *WAL) pruneSegments() error {
+	files, err := w.getAllSegments()
+	if err != nil {
+		return err
+	}
+	return w.processOldSegments(files)
+}
+
 func (w *WAL) syncInBackground() {
+	defer w.wg.Done()
 	for {
 		select {
-		case <-w.syncTimeTicker.C:
+		case <-w.syncTimeTicker.C():
 			w.lock.Lock()
-			err := w.Sync()
+			err := w.sync()
+			if err == nil && w.segmentExpired() {
+				err = w.rotate()
+			}
+			if err != nil {
+				w.lastSyncErr = err
+			} else if w.syncNotify != nil {
+				close(w.syncNotify)
+				w.syncNotify = nil
+			}
+			name := w.currentName
 			w.lock.Unlock()
 			if err != nil {
-				log.Println(err)
+				w.logger.Error("background sync failed", "segment", name, "error", err)
+				w.reportSyncError(err)
 			}
+		case <-w.done:
+			return
 		}
 	}
 }
 
+func (w *WAL) reportSyncError(err error) {
+	if w.syncErrors == nil {
+		return
+	}
+	select {
+	case w.syncErrors <- err:
+	default:
+	}
+}
+
+// LastRetentionError returns the error hit by the most recent pruning of old
+// segments, or nil if it succeeded. Pruning runs in the background after
+// each rotation.
+func (w *WAL) LastRetentionError() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.lastRetentionErr
+}
+
+// LastSyncError returns the most recent error hit by the background sync,
+// or nil if none has failed since the WAL was opened.
+func (w *WAL) LastSyncError() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.lastSyncErr
+}
+
+// Sync flushes buffered records and, unless fsync is disabled, fsyncs the
+// active segment.
 func (w *WAL) Sync() error {
-	return w.bufWriter.Flush()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	err := w.writable()
+	if err != nil {
+		return err
+	}
+	return w.sync()
+}
+
+// SyncN syncs like Sync and also returns how many buffered bytes it flushed
+// to the active segment. If the flush fails it counts the bytes written
+// before the failure; the rest stay buffered for a later sync.
+func (w *WAL) SyncN() (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	err := w.writable()
+	if err != nil {
+		return 0, err
+	}
+	pending := w.bufWriter.Buffered()
+	err = w.flush()
+	flushed := pending - w.bufWriter.Buffered()
+	if err != nil {
+		return flushed, err
+	}
+	return flushed, w.sync()
+}
+
+// SetSyncInterval changes how often the background sync runs, starting a
+// new period now. It has no effect unless SyncMode is SyncInterval.
+func (w *WAL) SetSyncInterval(period time.Duration) error {
+	if period <= 0 {
+		return ErrInvalidSyncPeriod
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	err := w.writable()
+	if err != nil {
+		return err
+	}
+	if w.syncTimeTicker != nil {
+		w.syncTimeTicker.Reset(period)
+	}
+	return nil
+}
+
+// WaitForSync blocks until the next background sync succeeds, after which
+// records written before the call are durable, or until ctx is done. It
+// returns ErrInvalidSyncMode unless SyncMode is SyncInterval, and
+// ErrWALClosed if the WAL is closed while waiting.
+func (w *WAL) WaitForSync(ctx context.Context) error {
+	w.lock.Lock()
+	err := w.writable()
+	if err == nil && w.syncTimeTicker == nil {
+		err = ErrInvalidSyncMode
+	}
+	if err != nil {
+		w.lock.Unlock()
+		return err
+	}
+	if w.syncNotify == nil {
+		w.syncNotify = make(chan struct{})
+	}
+	synced := w.syncNotify
+	w.lock.Unlock()
+	select {
+	case <-synced:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-w.done:
+		return ErrWALClosed
+	}
+}
+
+// writable reports why the WAL can't be modified, if it can't.
+func (w *WAL) writable() error {
+	if w.closed {
+		return ErrWALClosed
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Drain makes everything written so far durable while leaving the WAL open,
+// for instance before copying the segments for a backup. Unlike Sync it
+// fsyncs the active segment and the log directory even when fsync is
+// disabled.
+func (w *WAL) Drain() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	err := w.writable()
+	if err != nil {
+		return err
+	}
+	err = w.fsync()
+	if err != nil {
+		return err
+	}
+	return w.storage.Sync()
+}
+
+func (w *WAL) sync() error {
+	err := w.flush()
+	if err != nil {
+		return err
+	}
+	if !w.disableFsync {
+		err = w.currentLog.Sync()
+		if err != nil {
+			return diskError(err)
+		}
+	}
+	w.lastSyncTime = w.clock.Now()
+	return nil
+}
+
+// fsync flushes and fsyncs the active segment, ignoring DisableFsync.
+func (w *WAL) fsync() error {
+	err := w.flush()
+	if err != nil {
+		return err
+	}
+	err = w.currentLog.Sync()
+	if err != nil {
+		return diskError(err)
+	}
+	w.lastSyncTime = w.clock.Now()
+	return nil
+}
+
+// flush writes out the buffered records. Whatever it fails to write stays
+// buffered, so a later flush retries it once the cause, such as a full
+// disk, clears.
+func (w *WAL) flush() error {
+	err := w.bufWriter.Flush()
+	if err != nil {
+		return diskError(err)
+	}
+	return nil
+}
+
+// acknowledge marks every record written to the active segment so far as
+// acknowledged, so a later failed write never rolls it back.
+func (w *WAL) acknowledge() {
+	w.ackedSize = w.currentSize
+	w.ackedOffset = w.currentOffset
+	w.ackedRecords = w.segmentRecords
+}
+
+// rollback undoes the records written to the active segment since the last
+// acknowledged one, after the call writing them failed, and returns err.
+// Their bytes are dropped from the buffer or cut off the segment, so
+// nothing partial stays behind, and their offsets are handed out again. If
+// the segment can't be cut the next write rotates away from it, skipping
+// their offsets since the records may still be in it.
+func (w *WAL) rollback(err error) error {
+	next := w.currentOffset
+	w.index.truncate(w.segmentIndex, w.ackedOffset)
+	w.recordsWritten -= uint64(w.segmentRecords - w.ackedRecords)
+	w.currentOffset = w.ackedOffset
+	w.segmentRecords = w.ackedRecords
+	w.currentSize = w.ackedSize
+	if w.bufWriter.cut(w.ackedSize) {
+		return err
+	}
+	truncateErr := w.storage.Truncate(w.currentName, w.ackedSize)
+	if truncateErr != nil {
+		w.dirtyTail = true
+		w.currentOffset = next
+		w.logger.Error("cutting back a failed write failed", "segment", w.currentName, "error", truncateErr)
+		return err
+	}
+	w.bufWriter.written = w.ackedSize
+	return err
+}
+
+// diskError wraps a failure caused by a full disk in ErrDiskFull, keeping
+// the underlying error in the chain.
+func diskError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %w", ErrDiskFull, err)
+	}
+	return err
 }
 
 func (w *WAL) Close() error {
+	return w.CloseContext(context.Background())
+}
+
+// CloseContext stops the background sync, waits for it to exit and then
+// flushes and closes the active segment. If ctx is done first, ctx.Err() is
+// returned and the flush and close still happen in the background once the
+// background work has exited, logging any failure. Every later call,
+// including another Close, returns ErrWALClosed.
+func (w *WAL) CloseContext(ctx context.Context) error {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return ErrWALClosed
+	}
+	w.closed = true
+	w.lock.Unlock()
+	if w.syncTimeTicker != nil {
+		w.syncTimeTicker.Stop()
+	}
+	close(w.done)
+	finished := make(chan error, 1)
+	go func() {
+		w.wg.Wait()
+		finished <- w.closeActiveSegment()
+	}()
+	select {
+	case err := <-finished:
+		return err
+	case <-ctx.Done():
+		go func() {
+			err := <-finished
+			if err != nil {
+				w.logger.Error("closing the active segment failed", "error", err)
+			}
+		}()
+		return ctx.Err()
+	}
+}
+
+// closeActiveSegment makes the active segment durable and closes it.
+func (w *WAL) closeActiveSegment() error {
+	if w.readOnly {
+		return nil
+	}
 	w.lock.Lock()
 	defer w.lock.Unlock()
-	return w.Sync()
+	err := w.sync()
+	if err != nil {
+		w.currentLog.Close()
+		return err
+	}
+	return w.currentLog.Close()
 }
 
 func (w *WAL) getAllSegments() ([]string, error) {
-	entries, err := os.ReadDir(w.logDir)
+	names, err := w.storage.List()
 	if err != nil {
 		return nil, err
 	}
 	fileNames := make([]string, 0, 5)
-	for _, entry := range entries {
-		if entry.IsDir() {
+	for _, name := range names {
+		_, ok := w.parseSegmentName(name)
+		if !ok {
 			continue
 		}
-		fileNames = append(fileNames, entry.Name())
+		fileNames = append(fileNames, name)
 	}
 
 	return fileNames, nil
 }
 
+// parseSegmentName returns the index of the segment called name. Only names
+// this WAL generates are segments, which rules out hidden and temporary
+// files left by editors or sync agents, unpadded or otherwise stray files
+// sharing the prefix, and the segments of a WAL whose prefix extends this
+// one.
+func (w *WAL) parseSegmentName(name string) (uint64, bool) {
+	indexStr, ok := strings.CutPrefix(name, w.prefix)
+	if !ok {
+		return 0, false
+	}
+	index, err := strconv.ParseUint(indexStr, 10, 64)
+	if err != nil || w.segmentName(index) != name {
+		return 0, false
+	}
+	return index, true
+}
+
 func (w *WAL) processOldSegments(segments []string) error {
-	if len(segments) < w.maxSegments {
+	if w.noRetention {
+		return nil
+	}
+	if len(segments) < w.maxSegments && w.maxTotalBytes <= 0 {
 		return nil
 	}
 	err := w.deleteOldSegments(segments)
@@ -206,91 +1164,484 @@ func (w *WAL) deleteOldSegments(segments []string) error {
 		return err
 	}
 	sort.SliceStable(segmentsWithInfo, func(i, j int) bool {
-		return segmentsWithInfo[i].Timestamp < segmentsWithInfo[j].Timestamp
+		return segmentsWithInfo[i].Index < segmentsWithInfo[j].Index
 	})
-	count := len(segments)
-	for _, segment := range segmentsWithInfo {
-		if count <= w.maxSegments {
+	sizes := make([]int64, len(segmentsWithInfo))
+	var totalBytes int64
+	if w.maxTotalBytes > 0 {
+		for i, segment := range segmentsWithInfo {
+			// The active segment may still have bytes in the write buffer.
+			size := w.currentSize
+			if segment.Name != w.currentName {
+				size, err = w.storage.Size(segment.Name)
+				if err != nil {
+					return err
+				}
+			}
+			sizes[i] = size
+			totalBytes += sizes[i]
+		}
+	}
+	count := len(segmentsWithInfo)
+	for i, segment := range segmentsWithInfo {
+		if count <= w.maxSegments && (w.maxTotalBytes <= 0 || totalBytes <= w.maxTotalBytes) {
 			break
 		}
-		err := os.Remove(w.logDir + "/" + segment.Name)
+		if !w.removable(segment) {
+			break
+		}
+		if w.hasReadOffset {
+			nextOffset, ok, err := w.firstOffsetOf(segmentsWithInfo[i+1:])
+			if err != nil {
+				return err
+			}
+			if !ok {
+				nextOffset = w.currentOffset
+			}
+			if nextOffset > w.readOffset+1 {
+				return ErrRetentionBlocked
+			}
+		}
+		err := w.removeSegment(segment)
 		if err != nil {
 			return err
 		}
 		count -= 1
+		totalBytes -= sizes[i]
 	}
 	return nil
 }
 
+// removeSegment deletes a segment and makes the removal durable.
+func (w *WAL) removeSegment(segment *segmentInfo) error {
+	w.index.drop(segment.Index)
+	err := w.storage.Remove(segment.Name)
+	if err != nil {
+		return err
+	}
+	return w.syncStorage()
+}
+
+// syncStorage persists segment creations and removals, unless fsync is
+// disabled. Without it a crash can lose a new segment even though its
+// contents were synced.
+func (w *WAL) syncStorage() error {
+	if w.disableFsync {
+		return nil
+	}
+	return w.storage.Sync()
+}
+
+// removable reports whether segment may be deleted by retention. The
+// active segment, and anything that isn't older than it, never is: deleting
+// it would orphan the records still being written through the open handle.
+func (w *WAL) removable(segment *segmentInfo) bool {
+	return segment.Index < w.segmentIndex && segment.Name != w.currentName
+}
+
 func (w *WAL) getSegmentInfos(segments []string) ([]*segmentInfo, error) {
 	segmentsWithInfo := make([]*segmentInfo, 0, 5)
 	for _, segment := range segments {
-		if !strings.HasPrefix(segment, filePrefix) {
+		index, ok := w.parseSegmentName(segment)
+		if !ok {
 			continue
 		}
-		timestampStr := strings.ReplaceAll(segment, filePrefix, "")
-		timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
-		if err != nil {
-			return nil, err
-		}
 		segmentsWithInfo = append(segmentsWithInfo, &segmentInfo{
-			Name:      segment,
-			Timestamp: timestamp,
+			Name:  segment,
+			Index: index,
 		})
 	}
 	return segmentsWithInfo, nil
 }
 
-func (w *WAL) Recover(callback func([]byte) error) error {
+func (w *WAL) getSortedSegments() ([]*segmentInfo, error) {
 	segments, err := w.getAllSegments()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	segmentsWithInfo, err := w.getSegmentInfos(segments)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	sort.SliceStable(segmentsWithInfo, func(i, j int) bool {
-		return segmentsWithInfo[i].Timestamp < segmentsWithInfo[j].Timestamp
+		return segmentsWithInfo[i].Index < segmentsWithInfo[j].Index
+	})
+	return segmentsWithInfo, nil
+}
+
+// snapshotSegments flushes buffered records and lists the segments under the
+// lock, capping the active segment at its current size so readers see every
+// record written so far but nothing appended while they read.
+func (w *WAL) snapshotSegments() ([]*segmentInfo, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return nil, ErrWALClosed
+	}
+	if w.readOnly {
+		// Another process may be appending, so nothing is capped.
+		return w.getSortedSegments()
+	}
+	err := w.flush()
+	if err != nil {
+		return nil, err
+	}
+	segmentsWithInfo, err := w.getSortedSegments()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make([]*segmentInfo, 0, len(segmentsWithInfo))
+	for _, segmentWithInfo := range segmentsWithInfo {
+		if segmentWithInfo.Index == w.segmentIndex {
+			segmentWithInfo.limit = w.currentSize
+			if segmentWithInfo.limit == 0 {
+				continue
+			}
+		}
+		snapshot = append(snapshot, segmentWithInfo)
+	}
+	return snapshot, nil
+}
+
+// Recover replays every record oldest first. It stops at the first error
+// from callback and returns it, unless it is ErrStopRecovery, which ends
+// replay without error.
+func (w *WAL) Recover(callback func([]byte) error) error {
+	_, err := w.RecoverWithStats(callback)
+	return err
+}
+
+type RecoverResult struct {
+	// Recovered counts records passed to the callback.
+	Recovered int
+	// Skipped counts truncated records that ended a segment early.
+	Skipped int
+	// Corrupted counts records dropped for failing checksum validation.
+	Corrupted int
+	// LastOffset is the offset of the last recovered record.
+	LastOffset uint64
+}
+
+// RecoverWithStats behaves like Recover and also reports how many records
+// were recovered or lost to corruption. When callback fails, the result
+// covers the records replayed before the failure.
+func (w *WAL) RecoverWithStats(callback func([]byte) error) (RecoverResult, error) {
+	return w.recoverRecords(nil, func(record rawRecord) error {
+		return callback(record.data)
+	})
+}
+
+// RecoverTyped replays every record like Recover, along with the record
+// type it was written with. Records written by Write have type 0.
+func (w *WAL) RecoverTyped(callback func(recordType uint16, data []byte) error) error {
+	_, err := w.recoverRecords(nil, func(record rawRecord) error {
+		return callback(record.recordType, record.data)
+	})
+	return err
+}
+
+// RecoverDetailed replays every record like Recover, along with its offset,
+// length and a checksum of its data.
+func (w *WAL) RecoverDetailed(callback func(rec Record) error) error {
+	_, err := w.recoverRecords(nil, func(record rawRecord) error {
+		return callback(w.newRecord(record, record.data))
 	})
+	return err
+}
+
+// RecoverFiltered replays only the records whose type is in types. Other
+// records are still checksummed, so corruption among them is detected, but
+// their payloads are never decoded.
+func (w *WAL) RecoverFiltered(types []uint16, callback func(recordType uint16, data []byte) error) error {
+	wanted := make(map[uint16]bool, len(types))
+	for _, recordType := range types {
+		wanted[recordType] = true
+	}
+	_, err := w.recoverRecords(func(record rawRecord) bool {
+		return wanted[record.recordType]
+	}, func(record rawRecord) error {
+		return callback(record.recordType, record.data)
+	})
+	return err
+}
+
+func (w *WAL) recoverRecords(keep func(rawRecord) bool, callback func(rawRecord) error) (RecoverResult, error) {
+	var result RecoverResult
+	segmentsWithInfo, err := w.snapshotSegments()
+	if err != nil {
+		return result, err
+	}
 	for _, segmentWithInfo := range segmentsWithInfo {
-		segmentPath := w.logDir + "/" + segmentWithInfo.Name
-		err = w.recoverSegment(segmentPath, callback)
+		scan, err := w.recoverSegment(segmentWithInfo, keep, func(record rawRecord) error {
+			err := callback(record)
+			if err != nil {
+				return err
+			}
+			result.Recovered += 1
+			result.LastOffset = record.offset
+			return nil
+		})
+		result.Corrupted += scan.corrupted
+		if scan.torn {
+			result.Skipped += 1
+		}
 		if err != nil {
-			return err
+			return result, stopped(err)
 		}
 	}
-	return nil
+	return result, nil
 }
 
-func (w *WAL) recoverSegment(segmentPath string, callback func([]byte) error) error {
-	segment, err := os.Open(segmentPath)
+// stopped hides ErrStopRecovery, which a callback returns to end replay
+// early rather than to report a failure.
+func stopped(err error) error {
+	if err == ErrStopRecovery {
+		return nil
+	}
+	return err
+}
+
+// ReadSegment replays the records of a single segment, identified by its
+// index. It returns ErrSegmentNotFound if no such segment exists, and
+// callback errors like Recover.
+func (w *WAL) ReadSegment(index uint64, callback func([]byte) error) error {
+	segmentsWithInfo, err := w.snapshotSegments()
+	if err != nil {
+		return err
+	}
+	for _, segmentWithInfo := range segmentsWithInfo {
+		if segmentWithInfo.Index != index {
+			continue
+		}
+		_, err = w.recoverSegment(segmentWithInfo, nil, func(record rawRecord) error {
+			return callback(record.data)
+		})
+		return stopped(err)
+	}
+	return ErrSegmentNotFound
+}
+
+// RecoverFrom replays only the records whose offset is greater than the
+// given checkpoint offset, handling callback errors like Recover.
+func (w *WAL) RecoverFrom(checkpoint uint64, callback func([]byte) error) error {
+	if checkpoint == math.MaxUint64 {
+		// No offset is greater, and checkpoint+1 would wrap to 0.
+		return nil
+	}
+	return w.recoverFrom(checkpoint+1, func(record rawRecord) error {
+		return callback(record.data)
+	})
+}
+
+// recoverFrom replays records with an offset of at least start, skipping the
+// segments that end before it.
+func (w *WAL) recoverFrom(start uint64, callback func(rawRecord) error) error {
+	segmentsWithInfo, err := w.snapshotSegments()
+	if err != nil {
+		return err
+	}
+	first, err := w.segmentFor(segmentsWithInfo, start)
 	if err != nil {
 		return err
 	}
+	for _, segmentWithInfo := range segmentsWithInfo[first:] {
+		_, err = w.recoverSegment(segmentWithInfo, nil, func(record rawRecord) error {
+			if record.offset < start {
+				return nil
+			}
+			return callback(record)
+		})
+		if err != nil {
+			return stopped(err)
+		}
+	}
+	return nil
+}
+
+// segmentFor returns the position in segments of the last one whose first
+// record is at or before offset, or 0 if there is none.
+func (w *WAL) segmentFor(segmentsWithInfo []*segmentInfo, offset uint64) (int, error) {
+	segment, position, ok := w.lookupIndex(offset)
+	if ok {
+		for i, segmentWithInfo := range segmentsWithInfo {
+			if segmentWithInfo.Index == segment {
+				segmentWithInfo.start = position
+				return i, nil
+			}
+		}
+	}
+	for i := len(segmentsWithInfo) - 1; i >= 0; i-- {
+		firstOffset, ok, err := readFirstOffset(w.storage, segmentsWithInfo[i])
+		if err != nil {
+			return 0, err
+		}
+		if ok && firstOffset <= offset {
+			return i, nil
+		}
+	}
+	return 0, nil
+}
+
+func readFirstOffset(storage Storage, segmentWithInfo *segmentInfo) (uint64, bool, error) {
+	segment, decoder, err := openSegment(storage, segmentWithInfo)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
 	defer segment.Close()
-	scanner := bufio.NewScanner(segment)
-	for scanner.Scan() {
-		info := scanner.Bytes()
-		if len(info) < 16 {
-			log.Println(ErrBytesLength)
+	for {
+		record, err := decoder.next()
+		if err == ErrChecksumValidation {
+			_, err = decoder.resync()
+			if err != nil {
+				return 0, false, err
+			}
 			continue
 		}
+		if err == io.EOF || err == ErrBytesLength {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		return record.offset, true, nil
+	}
+}
+
+// openSegment opens a segment for decoding, honouring the snapshot limit.
+func openSegment(storage Storage, segmentWithInfo *segmentInfo) (File, *segmentDecoder, error) {
+	segment, err := storage.Open(segmentWithInfo.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	size := segmentWithInfo.limit
+	if size <= 0 {
+		size, err = segment.Size()
+		if err != nil {
+			segment.Close()
+			return nil, nil, err
+		}
+	}
+	decoder, err := newSegmentDecoder(io.NewSectionReader(segment, 0, size))
+	if err != nil {
+		segment.Close()
+		return nil, nil, err
+	}
+	if segmentWithInfo.start > decoder.pos {
+		err = decoder.seek(segmentWithInfo.start)
+		if err != nil {
+			segment.Close()
+			return nil, nil, err
+		}
+	}
+	return segment, decoder, nil
+}
+
+// recoverSegment calls callback with every record of a segment, its data
+// replaced by the decoded payload. When keep is set, records it rejects are
+// still validated but neither decoded nor passed on.
+func (w *WAL) recoverSegment(segmentWithInfo *segmentInfo, keep func(rawRecord) bool, callback func(rawRecord) error) (segmentScan, error) {
+	scan, err := w.scanSegment(segmentWithInfo, w.recoveryMode, func(record rawRecord) error {
+		if keep != nil && !keep(record) {
+			return nil
+		}
+		data, err := w.payload.decode(record)
+		if err != nil {
+			return err
+		}
+		record.data = data
+		return callback(record)
+	})
+	return scan, err
+}
 
-		checksumBytes := info[12:16]
-		data := info[16:]
+type segmentScan struct {
+	version   byte
+	checksum  ChecksumAlgorithm
+	created   time.Time
+	validSize int64
+	torn      bool
+	// padded reports zero padding after the records, from validSize on.
+	padded    bool
+	corrupted int
+	corruptAt []int64
+	// records counts the valid records passed to the callback, the last
+	// of which had offset lastOffset.
+	records    int
+	lastOffset uint64
+}
 
-		precomputedChecksum := binary.LittleEndian.Uint32(checksumBytes)
-		calculatedChecksum := crc32.ChecksumIEEE(data)
+// scanSegment calls callback with every valid raw record in a segment and
+// stops at the first truncated record. A segment removed since it was
+// listed is treated as empty.
+func (w *WAL) scanSegment(segmentWithInfo *segmentInfo, mode RecoveryMode, callback func(rawRecord) error) (segmentScan, error) {
+	var scan segmentScan
+	segment, decoder, err := openSegment(w.storage, segmentWithInfo)
+	if errors.Is(err, os.ErrNotExist) {
+		return scan, nil
+	}
+	if err != nil {
+		return scan, err
+	}
+	defer segment.Close()
+	scan.version = decoder.version
+	scan.checksum = decoder.checksum
+	scan.created = decoder.created
+	err = w.scanRecords(segmentWithInfo.Name, decoder, mode, &scan, callback)
+	if err != nil {
+		return scan, err
+	}
+	scan.validSize = decoder.pos
+	scan.padded = decoder.padded
+	return scan, nil
+}
 
-		if precomputedChecksum != calculatedChecksum {
-			log.Println(ErrChecksumValidation)
+// scanRecords calls callback with every valid raw record decoder reads,
+// counting them in scan, and stops at the first truncated record.
+func (w *WAL) scanRecords(name string, decoder *segmentDecoder, mode RecoveryMode, scan *segmentScan, callback func(rawRecord) error) error {
+	for {
+		record, err := decoder.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == ErrChecksumValidation {
+			w.logger.Warn("corrupt record", "segment", name, "position", decoder.lastStart, "error", err)
+			scan.corrupted += 1
+			scan.corruptAt = append(scan.corruptAt, decoder.lastStart)
+			if mode == RecoveryStrict {
+				return err
+			}
+			_, err = decoder.resync()
+			if err != nil {
+				return err
+			}
 			continue
 		}
-		err = callback(data)
+		if err == ErrBytesLength && mode == RecoveryLenient {
+			corruptAt := decoder.lastStart
+			found, err := decoder.resync()
+			if err != nil {
+				return err
+			}
+			if found {
+				w.logger.Warn("corrupt record", "segment", name, "position", corruptAt, "error", ErrChecksumValidation)
+				scan.corrupted += 1
+				scan.corruptAt = append(scan.corruptAt, corruptAt)
+				continue
+			}
+		}
 		if err != nil {
-			break
+			w.logger.Warn("torn record", "segment", name, "position", decoder.lastStart, "error", err)
+			scan.torn = true
+			return nil
 		}
+		err = callback(record)
+		if err != nil {
+			return err
+		}
+		scan.records += 1
+		scan.lastOffset = record.offset
 	}
-	return nil
 }
@@ -0,0 +1,2326 @@
+package tinywal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// openWAL opens a WAL in dir and closes it when the test ends.
+func openWAL(t *testing.T, dir string, opts ...Option) *WAL {
+	t.Helper()
+	w, err := NewWithOptions(dir, opts...)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+// recoverAll returns the payload of every record in w, oldest first.
+func recoverAll(t *testing.T, w *WAL) []string {
+	t.Helper()
+	var records []string
+	err := w.Recover(func(data []byte) error {
+		records = append(records, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	return records
+}
+
+// waitForPrune waits until the retention scheduled by earlier rotations has
+// run.
+func waitForPrune(t *testing.T, w *WAL) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		w.lock.Lock()
+		pending := w.prunePending
+		w.lock.Unlock()
+		if !pending {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("retention didn't run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// testStorage keeps segments in memory and counts the handles Create has
+// opened that are still open, and how often they have been fsynced. Fsyncs,
+// removals and truncations fail with syncErr, removeErr and truncateErr
+// while they are set. Writes fail with ENOSPC once they would take more than
+// space bytes, unless space is negative.
+type testStorage struct {
+	Storage
+	lock        sync.Mutex
+	writers     int
+	syncs       int
+	dirSyncs    int
+	syncErr     error
+	removeErr   error
+	truncateErr error
+	space       int64
+}
+
+func newTestStorage() *testStorage {
+	return &testStorage{Storage: NewMemoryStorage(), space: -1}
+}
+
+func (s *testStorage) Create(name string) (File, error) {
+	file, err := s.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.writers += 1
+	return &testFile{File: file, storage: s}, nil
+}
+
+func (s *testStorage) Remove(name string) error {
+	s.lock.Lock()
+	err := s.removeErr
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.Storage.Remove(name)
+}
+
+func (s *testStorage) failRemoves(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.removeErr = err
+}
+
+func (s *testStorage) Truncate(name string, size int64) error {
+	s.lock.Lock()
+	err := s.truncateErr
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.Storage.Truncate(name, size)
+}
+
+func (s *testStorage) failTruncates(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.truncateErr = err
+}
+
+// Sync counts syncs of the storage itself, as opposed to its files.
+func (s *testStorage) Sync() error {
+	s.lock.Lock()
+	s.dirSyncs += 1
+	s.lock.Unlock()
+	return s.Storage.Sync()
+}
+
+func (s *testStorage) storageSyncs() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dirSyncs
+}
+
+func (s *testStorage) openWriters() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.writers
+}
+
+type testFile struct {
+	File
+	storage *testStorage
+}
+
+func (s *testStorage) fileSyncs() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.syncs
+}
+
+func (s *testStorage) failSyncs(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.syncErr = err
+}
+
+func (s *testStorage) limitSpace(space int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.space = space
+}
+
+func (f *testFile) Write(p []byte) (int, error) {
+	f.storage.lock.Lock()
+	space := f.storage.space
+	if space >= 0 && int64(len(p)) > space {
+		f.storage.space = 0
+		f.storage.lock.Unlock()
+		n, _ := f.File.Write(p[:space])
+		return n, syscall.ENOSPC
+	}
+	if space >= 0 {
+		f.storage.space -= int64(len(p))
+	}
+	f.storage.lock.Unlock()
+	return f.File.Write(p)
+}
+
+func (f *testFile) Sync() error {
+	f.storage.lock.Lock()
+	f.storage.syncs += 1
+	err := f.storage.syncErr
+	f.storage.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *testFile) Close() error {
+	err := f.File.Close()
+	if err == nil {
+		f.storage.lock.Lock()
+		f.storage.writers -= 1
+		f.storage.lock.Unlock()
+	}
+	return err
+}
+
+func TestNewReopensExistingLogDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	w := openWAL(t, dir)
+	_, err := w.Write([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, dir)
+	records := recoverAll(t, w)
+	if len(records) != 1 || records[0] != "first" {
+		t.Fatalf("records = %q, want [first]", records)
+	}
+}
+
+func TestNewRejectsFileAsLogDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	err := os.WriteFile(path, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewWithOptions(path)
+	if !errors.Is(err, ErrLogDirNotDirectory) {
+		t.Fatalf("err = %v, want ErrLogDirNotDirectory", err)
+	}
+}
+
+func TestRecoverAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir, WithSegmentSize(64))
+	want := []string{"a", "b", "c", "d", "e"}
+	for _, record := range want {
+		_, err := w.Write([]byte(record))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, dir, WithSegmentSize(64))
+	got := recoverAll(t, w)
+	if len(got) != len(want) {
+		t.Fatalf("records = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("records = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestRecoverSkipsUnparsableNames(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, filePrefix+"-1700000000"), []byte("junk"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := openWAL(t, dir)
+	_, err = w.Write([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := recoverAll(t, w)
+	if len(records) != 1 || records[0] != "a" {
+		t.Fatalf("records = %q, want [a]", records)
+	}
+}
+
+func TestRecoverIgnoresHiddenAndTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	writeNumbered(t, w, 3)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := filepath.Base(w.CurrentSegment())
+	for _, name := range []string{".segment-123.tmp", "." + segment, segment + ".tmp", segment + "~"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte("junk"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w = openWAL(t, dir)
+	if records := recoverAll(t, w); fmt.Sprint(records) != "[0 1 2]" {
+		t.Fatalf("records = %q, want 0 to 2", records)
+	}
+	offset, err := w.Write([]byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 3 {
+		t.Fatalf("offset = %d, want 3", offset)
+	}
+}
+
+func TestCloseStopsGoroutinesAndClosesSegment(t *testing.T) {
+	before := runtime.NumGoroutine()
+	storage := newTestStorage()
+	w, err := NewWithOptions("", WithStorage(storage), WithSyncPeriod(time.Millisecond),
+		WithOnRotate(func(SegmentMeta) error { return nil }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := storage.openWriters(); n != 0 {
+		t.Fatalf("%d segment handles left open", n)
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines = %d, want at most %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRecoverBinaryPayloads(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	want := []string{"line one\nline two\n", "\x00\x00\n\x00", "\n", "{\"a\":\n1}"}
+	for _, record := range want {
+		_, err := w.Write([]byte(record))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, dir)
+	got := recoverAll(t, w)
+	if len(got) != len(want) {
+		t.Fatalf("records = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("record %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestRecoverLargeRecord(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	want := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	_, err := w.Write(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, dir)
+	got := recoverAll(t, w)
+	if len(got) != 1 || got[0] != string(want) {
+		t.Fatalf("recovered %d records, want one of %d bytes", len(got), len(want))
+	}
+}
+
+func TestRecoverSegmentReportsLastOffset(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(88), WithMaxSegments(100))
+	// Four records fill a segment, so ten leave 0-3, 4-7 and 8-9.
+	writeNumbered(t, w, 10)
+	err := w.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	segmentsWithInfo, err := w.getSortedSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, segmentWithInfo := range segmentsWithInfo {
+		scan, err := w.recoverSegment(segmentWithInfo, nil, func(rawRecord) error {
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d@%d", scan.records, scan.lastOffset))
+	}
+	if fmt.Sprint(got) != "[4@3 4@7 2@9]" {
+		t.Fatalf("records@last offset per segment = %v, want [4@3 4@7 2@9]", got)
+	}
+}
+
+func TestRecoverStopsAcrossSegments(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(88), WithMaxSegments(100))
+	writeNumbered(t, w, 10)
+	failure := errors.New("apply failed")
+	for _, test := range []struct {
+		name string
+		stop error
+		want error
+	}{
+		{"sentinel", ErrStopRecovery, nil},
+		{"error", failure, failure},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var seen []string
+			// Record 5 is in the second segment, so the stop has to carry
+			// past the end of the segment it happened in.
+			err := w.Recover(func(data []byte) error {
+				seen = append(seen, string(data))
+				if string(data) == "5" {
+					return test.stop
+				}
+				return nil
+			})
+			if err != test.want {
+				t.Fatalf("err = %v, want %v", err, test.want)
+			}
+			if fmt.Sprint(seen) != "[0 1 2 3 4 5]" {
+				t.Fatalf("saw %q, want 0 to 5", seen)
+			}
+			seen = nil
+			err = w.RecoverFrom(1, func(data []byte) error {
+				seen = append(seen, string(data))
+				if string(data) == "5" {
+					return test.stop
+				}
+				return nil
+			})
+			if err != test.want {
+				t.Fatalf("RecoverFrom: err = %v, want %v", err, test.want)
+			}
+			if fmt.Sprint(seen) != "[2 3 4 5]" {
+				t.Fatalf("RecoverFrom saw %q, want 2 to 5", seen)
+			}
+		})
+	}
+}
+
+func TestRecoverReturnsCallbackError(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()))
+	writeNumbered(t, w, 5)
+	failure := errors.New("apply failed")
+	var calls int
+	apply := func() error {
+		calls += 1
+		if calls == 3 {
+			return failure
+		}
+		return nil
+	}
+	for name, recovery := range map[string]func() error{
+		"Recover": func() error {
+			return w.Recover(func([]byte) error { return apply() })
+		},
+		"RecoverTyped": func() error {
+			return w.RecoverTyped(func(uint16, []byte) error { return apply() })
+		},
+		"RecoverDetailed": func() error {
+			return w.RecoverDetailed(func(Record) error { return apply() })
+		},
+		"RecoverWithStats": func() error {
+			_, err := w.RecoverWithStats(func([]byte) error { return apply() })
+			return err
+		},
+	} {
+		calls = 0
+		err := recovery()
+		if err != failure {
+			t.Fatalf("%s: err = %v, want the callback's error", name, err)
+		}
+		if calls != 3 {
+			t.Fatalf("%s: %d callbacks, want recovery to stop at the third", name, calls)
+		}
+	}
+}
+
+func TestRecoverFromCheckpoint(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(4096), WithMaxSegments(100))
+	for i := 0; i < 1000; i++ {
+		_, err := w.Write([]byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Offsets start at 0, so the 500th record has offset 499.
+	var replayed []string
+	err := w.RecoverFrom(499, func(data []byte) error {
+		replayed = append(replayed, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 500 {
+		t.Fatalf("replayed %d records, want 500", len(replayed))
+	}
+	if replayed[0] != "500" || replayed[499] != "999" {
+		t.Fatalf("replayed %q to %q, want 500 to 999", replayed[0], replayed[499])
+	}
+	err = w.RecoverFrom(math.MaxUint64, func(data []byte) error {
+		t.Fatalf("replayed %q past the largest offset", data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOffsetsIncreaseAcrossSegments(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(100))
+	for i := 0; i < 20; i++ {
+		offset, err := w.Write([]byte("record"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != uint64(i) {
+			t.Fatalf("offset = %d, want %d", offset, i)
+		}
+	}
+	segments, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 3 {
+		t.Fatalf("got %d segments, want several", len(segments))
+	}
+	next := uint64(0)
+	for _, segment := range segments {
+		if segment.Records == 0 {
+			continue
+		}
+		if segment.FirstOffset != next {
+			t.Fatalf("segment %d starts at %d, want %d", segment.Index, segment.FirstOffset, next)
+		}
+		next = segment.LastOffset + 1
+	}
+	if next != 20 {
+		t.Fatalf("segments end before offset %d, want 20", next)
+	}
+}
+
+func TestOffsetsContinueAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	for i := 0; i < 3; i++ {
+		_, err := w.Write([]byte("before"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, dir)
+	offset, err := w.Write([]byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 3 {
+		t.Fatalf("offset = %d, want 3", offset)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts []Option
+		dir  string
+		want error
+	}{
+		{"empty log dir", nil, "", ErrEmptyLogDir},
+		{"zero segment size", []Option{WithSegmentSize(0)}, "wal", ErrInvalidSegmentSize},
+		{"negative segment size", []Option{WithSegmentSize(-1)}, "wal", ErrInvalidSegmentSize},
+		{"tiny segment size", []Option{WithSegmentSize(8)}, "wal", ErrSegmentSizeTooSmall},
+		{"segment size below one record", []Option{WithSegmentSize(minSegmentSize - 1)}, "wal", ErrSegmentSizeTooSmall},
+		{"segment size below the record cap", []Option{WithSegmentSize(segmentSizeFor(64) - 1), WithMaxRecordSize(64)}, "wal", ErrSegmentSizeTooSmall},
+		{"zero max segments", []Option{WithMaxSegments(0)}, "wal", ErrInvalidMaxSegments},
+		{"zero sync period", []Option{WithSyncPeriod(0)}, "wal", ErrInvalidSyncPeriod},
+		{"negative sync period", []Option{WithSyncPeriod(-time.Second)}, "wal", ErrInvalidSyncPeriod},
+		{"unknown sync mode", []Option{WithSyncMode(SyncNever + 1)}, "wal", ErrInvalidSyncMode},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := test.dir
+			if dir != "" {
+				dir = filepath.Join(t.TempDir(), dir)
+			}
+			_, err := NewWithOptions(dir, test.opts...)
+			if err != test.want {
+				t.Fatalf("err = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	w, err := NewWithOptions(b.TempDir(), WithSegmentSize(4<<20))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+	data := []byte("SET X 23")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := w.Write(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "writes/s")
+}
+
+func BenchmarkBufferSize(b *testing.B) {
+	data := bytes.Repeat([]byte("x"), 512)
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			w, err := NewWithOptions(b.TempDir(), WithSegmentSize(64<<20), WithBufferSize(size), WithSyncMode(SyncNever))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer w.Close()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := w.Write(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBufferSizeHoldsWritesUntilFull(t *testing.T) {
+	storage := NewMemoryStorage()
+	w := openWAL(t, "", WithStorage(storage), WithBufferSize(1024), WithSyncMode(SyncNever))
+	name := filepath.Base(w.CurrentSegment())
+	size := func() int64 {
+		t.Helper()
+		size, err := storage.Size(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return size
+	}
+	// Each record takes 119 bytes, so eight fit after the header.
+	data := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < 8; i++ {
+		_, err := w.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := size(); n != 0 {
+		t.Fatalf("segment has %d bytes while the buffer has room, want 0", n)
+	}
+	_, err := w.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := size(); n != segmentHeaderSize+createdAtSize+8*encodedSize(100) {
+		t.Fatalf("segment has %d bytes, want the eight records flushed to make room", n)
+	}
+	err = w.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := size(); n != segmentHeaderSize+createdAtSize+9*encodedSize(100) {
+		t.Fatalf("segment has %d bytes after Sync, want all nine records", n)
+	}
+}
+
+func TestRotatesOnceSegmentSizeIsExceeded(t *testing.T) {
+	// A 16-byte header plus four 24-byte "hello" records passes 88 bytes
+	// only with the fourth record, so the fifth starts a new segment.
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(88))
+	for i := 0; i < 5; i++ {
+		_, err := w.Write([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("got %d segments, want 2", len(segments))
+	}
+	if segments[0].Records != 4 || segments[1].Records != 1 {
+		t.Fatalf("segments hold %d and %d records, want 4 and 1", segments[0].Records, segments[1].Records)
+	}
+	if segments[0].Size != 112 {
+		t.Fatalf("first segment is %d bytes, want 112", segments[0].Size)
+	}
+}
+
+func TestSegmentSizeFloorHoldsSeveralRecords(t *testing.T) {
+	const maxRecordSize = 64
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(segmentSizeFor(maxRecordSize)),
+		WithMaxRecordSize(maxRecordSize), WithMaxSegments(100))
+	writeNumbered(t, w, 10)
+	_, err := w.Write(make([]byte, maxRecordSize))
+	if err != nil {
+		t.Fatalf("record at the limit: %v", err)
+	}
+	segments, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Small records share segments, and even the largest fits in one.
+	if len(segments) != 3 || segments[0].Records != 5 || segments[1].Records != 5 || segments[2].Records != 1 {
+		t.Fatalf("segments = %+v, want 5, 5 and 1 records", segments)
+	}
+	if records := recoverAll(t, w); len(records) != 11 || fmt.Sprint(records[:10]) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Fatalf("records = %q, want 0 to 9 and the large record", records)
+	}
+}
+
+func TestWriteBatchAssignsContiguousOffsets(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithSegmentSize(64), WithMaxSegments(100))
+	_, err := w.Write([]byte("before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := w.WriteBatch([][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 1 {
+		t.Fatalf("first offset = %d, want 1", first)
+	}
+	got := recoverAll(t, w)
+	want := []string{"before", "a", "b", "c", "d"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("records = %q, want %q", got, want)
+	}
+	segments, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 2 {
+		t.Fatalf("got %d segments, want the batch to rotate", len(segments))
+	}
+}
+
+func BenchmarkWriteLoop(b *testing.B) {
+	benchmarkBatches(b, func(w *WAL, records [][]byte) error {
+		for _, data := range records {
+			_, err := w.Write(data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	benchmarkBatches(b, func(w *WAL, records [][]byte) error {
+		_, err := w.WriteBatch(records)
+		return err
+	})
+}
+
+// benchmarkBatches times write appending batches of 100 records.
+func benchmarkBatches(b *testing.B, write func(*WAL, [][]byte) error) {
+	w, err := NewWithOptions(b.TempDir(), WithSegmentSize(4<<20))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+	records := make([][]byte, 100)
+	for i := range records {
+		records[i] = []byte("SET X 23")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := write(w, records)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N*len(records))/b.Elapsed().Seconds(), "writes/s")
+}
+
+func TestCloseContextReturnsWhenCancelled(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	w, err := NewWithOptions("", WithStorage(NewMemoryStorage()),
+		WithOnRotate(func(SegmentMeta) error {
+			<-release
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = w.CloseContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("CloseContext took %v after its deadline", elapsed)
+	}
+}
+
+func TestSequentialWritesAppend(t *testing.T) {
+	dir := t.TempDir()
+	var want []string
+	for session := 0; session < 3; session++ {
+		w := openWAL(t, dir)
+		for i := 0; i < 10; i++ {
+			record := fmt.Sprintf("%d-%d", session, i)
+			_, err := w.Write([]byte(record))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, record)
+		}
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := openWAL(t, dir)
+	got := recoverAll(t, w)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("records = %q, want %q", got, want)
+	}
+}
+
+func TestReopenResumesNewestSegment(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir, WithSegmentSize(88))
+	writeNumbered(t, w, 2)
+	first := w.CurrentSegment()
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, dir, WithSegmentSize(88))
+	if w.CurrentSegment() != first {
+		t.Fatalf("reopened into %s, want to resume %s", w.CurrentSegment(), first)
+	}
+	if n := w.Stats().Segments; n != 1 {
+		t.Fatalf("%d segments, want 1", n)
+	}
+	writeNumbered(t, w, 2)
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Four records fill the segment, so the next session starts another.
+	w = openWAL(t, dir, WithSegmentSize(88))
+	if w.CurrentSegment() == first {
+		t.Fatal("resumed a full segment")
+	}
+	if records := recoverAll(t, w); fmt.Sprint(records) != "[0 1 0 1]" {
+		t.Fatalf("records = %q, want both sessions' records", records)
+	}
+	var offsets []uint64
+	err = w.RecoverDetailed(func(record Record) error {
+		offsets = append(offsets, record.Offset)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(offsets) != "[0 1 2 3]" {
+		t.Fatalf("offsets = %v, want 0 to 3", offsets)
+	}
+}
+
+func TestReopenAfterTornTailStartsNewSegment(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	writeNumbered(t, w, 2)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := appendTornRecord(t, dir, 2)
+	w = openWAL(t, dir)
+	if filepath.Base(w.CurrentSegment()) == filepath.Base(torn) {
+		t.Fatal("resumed a segment ending in a torn record")
+	}
+	offset, err := w.Write([]byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 2 {
+		t.Fatalf("offset = %d, want 2", offset)
+	}
+}
+
+func TestRetentionIgnoresForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+	foreign := []string{"README.txt", ".DS_Store"}
+	for _, name := range foreign {
+		err := os.WriteFile(filepath.Join(dir, name), []byte("keep me"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := openWAL(t, dir, WithSegmentSize(64), WithMaxSegments(2))
+	for i := 0; i < 20; i++ {
+		_, err := w.Write([]byte("record"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForPrune(t, w)
+	if n := w.Stats().Segments; n != 2 {
+		t.Fatalf("Stats counts %d segments, want 2", n)
+	}
+	for _, name := range foreign {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestNoRetentionKeepsEverySegment(t *testing.T) {
+	config := &Config{LogDir: t.TempDir(), SegmentSize: 64, SyncTimePeriod: time.Second, NoRetention: true, MaxTotalBytes: 100}
+	w, err := New(config)
+	if err != nil {
+		t.Fatalf("New with NoRetention and no MaxSegments: %v", err)
+	}
+	defer w.Close()
+	writeNumbered(t, w, 100)
+	// Three 20-byte records fit each 64-byte segment after its header.
+	if n := w.Stats().Segments; n != 34 {
+		t.Fatalf("%d segments, want all 34", n)
+	}
+	records := recoverAll(t, w)
+	if len(records) != 100 || records[0] != "0" {
+		t.Fatalf("recovered %d records, want all 100", len(records))
+	}
+}
+
+func TestRetentionFailureDoesntFailWrites(t *testing.T) {
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithSegmentSize(64), WithMaxSegments(2))
+	injected := errors.New("permission denied")
+	storage.failRemoves(injected)
+	writeNumbered(t, w, 20)
+	waitForPrune(t, w)
+	if err := w.LastRetentionError(); !errors.Is(err, injected) {
+		t.Fatalf("LastRetentionError = %v, want the injected error", err)
+	}
+	if n := w.Stats().Segments; n <= 2 {
+		t.Fatalf("%d segments, want the ones retention couldn't remove kept", n)
+	}
+	// The next rotation retries, and success clears the error.
+	storage.failRemoves(nil)
+	writeNumbered(t, w, 3)
+	waitForPrune(t, w)
+	if err := w.LastRetentionError(); err != nil {
+		t.Fatalf("LastRetentionError = %v after retention recovered, want nil", err)
+	}
+	if n := w.Stats().Segments; n != 2 {
+		t.Fatalf("%d segments, want 2", n)
+	}
+}
+
+func TestRapidRotationsKeepRecords(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir, WithMaxSegments(100))
+	for i := 0; i < 20; i++ {
+		_, err := w.Write([]byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 21 {
+		t.Fatalf("got %d segments, want 21", len(segments))
+	}
+	for i, segment := range segments[:20] {
+		if segment.Records != 1 || segment.FirstOffset != uint64(i) {
+			t.Fatalf("segment %s holds %d records from %d, want 1 from %d",
+				segment.Name, segment.Records, segment.FirstOffset, i)
+		}
+	}
+	if n := len(recoverAll(t, w)); n != 20 {
+		t.Fatalf("recovered %d records, want 20", n)
+	}
+}
+
+func TestSyncModes(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		mode  SyncMode
+		syncs int
+	}{
+		{"always", SyncAlways, 3},
+		{"interval", SyncInterval, 0},
+		{"never", SyncNever, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			storage := newTestStorage()
+			w := openWAL(t, "", WithStorage(storage), WithSyncMode(test.mode), WithSyncPeriod(time.Hour))
+			for i := 0; i < 3; i++ {
+				_, err := w.Write([]byte("record"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := storage.fileSyncs(); n != test.syncs {
+				t.Fatalf("%d fsyncs after 3 writes, want %d", n, test.syncs)
+			}
+			err := w.Sync()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := storage.fileSyncs(); n != test.syncs+1 {
+				t.Fatalf("%d fsyncs after Sync, want %d", n, test.syncs+1)
+			}
+		})
+	}
+}
+
+func TestSyncIntervalSyncsInBackground(t *testing.T) {
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithSyncPeriod(time.Millisecond))
+	_, err := w.Write([]byte("record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for storage.fileSyncs() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("background sync never fsynced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBackgroundSyncErrorIsObservable(t *testing.T) {
+	storage := newTestStorage()
+	syncErrors := make(chan error, 1)
+	w := openWAL(t, "", WithStorage(storage), WithSyncPeriod(time.Millisecond), WithSyncErrors(syncErrors))
+	injected := errors.New("injected sync failure")
+	storage.failSyncs(injected)
+	_, err := w.Write([]byte("record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-syncErrors:
+		if !errors.Is(err, injected) {
+			t.Fatalf("reported %v, want the injected error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("background sync error was never reported")
+	}
+	if err := w.LastSyncError(); !errors.Is(err, injected) {
+		t.Fatalf("LastSyncError = %v, want the injected error", err)
+	}
+	storage.failSyncs(nil)
+}
+
+func TestMaxTotalBytesPrunesOldestSegments(t *testing.T) {
+	const budget = 1000
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithMaxSegments(100), WithMaxTotalBytes(budget))
+	sizes := []int{100, 400, 50, 300, 200, 600, 10}
+	for _, size := range sizes {
+		_, err := w.Write(bytes.Repeat([]byte("x"), size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForPrune(t, w)
+		used, err := w.DiskUsage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used > budget {
+			t.Fatalf("%d bytes on disk, want at most %d", used, budget)
+		}
+	}
+	// Each segment adds 35 bytes of framing and the active one is a 16 byte
+	// header, so the 200, 600 and 10 byte records fit and the 300 doesn't.
+	records := recoverAll(t, w)
+	if len(records) != 3 || len(records[0]) != 200 || len(records[2]) != 10 {
+		t.Fatalf("kept %d records, want the newest three", len(records))
+	}
+}
+
+// appendTornRecord writes the first half of a record to the end of the only
+// segment in dir, as a crash mid-write would.
+func appendTornRecord(t *testing.T, dir string, offset uint64) string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"))
+	if err != nil || len(names) != 1 {
+		t.Fatalf("segments = %q, %v; want one", names, err)
+	}
+	record := encodeRecord(t, offset, []byte("torn record"))
+	file, err := os.OpenFile(names[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, err = file.Write(record[:len(record)/2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names[0]
+}
+
+func TestRecoverStopsAtTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	writeNumbered(t, w, 3)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendTornRecord(t, dir, 3)
+	w = openWAL(t, dir)
+	result, err := w.RecoverWithStats(func([]byte) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Recovered != 3 || result.Skipped != 1 || result.LastOffset != 2 {
+		t.Fatalf("result = %+v, want 3 recovered and the torn tail skipped", result)
+	}
+	offset, err := w.Write([]byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 3 {
+		t.Fatalf("offset = %d, want 3", offset)
+	}
+	if records := recoverAll(t, w); len(records) != 4 || records[3] != "3" {
+		t.Fatalf("records = %q, want 0 to 3", records)
+	}
+}
+
+func TestTruncateTornTail(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	writeNumbered(t, w, 3)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := appendTornRecord(t, dir, 3)
+	w = openWAL(t, dir, WithTruncateTornTail(true))
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(segmentHeaderSize + createdAtSize + 3*encodedSize(1)); info.Size() != want {
+		t.Fatalf("segment is %d bytes, want it cut back to %d", info.Size(), want)
+	}
+	_, err = w.Write([]byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := w.RecoverWithStats(func([]byte) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Recovered != 4 || result.Skipped != 0 {
+		t.Fatalf("result = %+v, want 4 recovered and nothing skipped", result)
+	}
+}
+
+func TestRecoverWithStatsCountsCorruption(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	writeNumbered(t, w, 5)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip the payload byte of the records at offsets 1 and 3.
+	corruptSegment(t, dir, 1, recordHeaderSize(segmentVersion))
+	corruptSegment(t, dir, 3, recordHeaderSize(segmentVersion))
+	w = openWAL(t, dir)
+	var records []string
+	result, err := w.RecoverWithStats(func(data []byte) error {
+		records = append(records, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Recovered != 3 || result.Corrupted != 2 || result.Skipped != 0 || result.LastOffset != 4 {
+		t.Fatalf("result = %+v, want 3 recovered and 2 corrupted", result)
+	}
+	if fmt.Sprint(records) != "[0 2 4]" {
+		t.Fatalf("records = %q, want [0 2 4]", records)
+	}
+}
+
+// corruptSegment flips a bit at position within the record at offset in the
+// only segment in dir, which must hold records with one-byte payloads.
+func corruptSegment(t *testing.T, dir string, offset int64, position int) {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"))
+	if err != nil || len(names) != 1 {
+		t.Fatalf("segments = %q, %v; want one", names, err)
+	}
+	data, err := os.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[segmentHeaderSize+createdAtSize+offset*encodedSize(1)+int64(position)] ^= 1
+	err = os.WriteFile(names[0], data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoveryModes(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		mode     RecoveryMode
+		position int
+		want     string
+		err      error
+	}{
+		{"strict", RecoveryStrict, recordHeaderSize(segmentVersion), "[0 1]", ErrChecksumValidation},
+		{"lenient payload", RecoveryLenient, recordHeaderSize(segmentVersion), "[0 1 3 4]", nil},
+		// A corrupt length desyncs the framing, so lenient recovery has
+		// to scan forward for the next intact record.
+		{"lenient length", RecoveryLenient, 9, "[0 1 3 4]", nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := openWAL(t, dir)
+			writeNumbered(t, w, 5)
+			err := w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			corruptSegment(t, dir, 2, test.position)
+			w = openWAL(t, dir, WithRecoveryMode(test.mode))
+			var records []string
+			err = w.Recover(func(data []byte) error {
+				records = append(records, string(data))
+				return nil
+			})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("err = %v, want %v", err, test.err)
+			}
+			if fmt.Sprint(records) != test.want {
+				t.Fatalf("records = %q, want %s", records, test.want)
+			}
+			reader, err := w.NewReader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			records = nil
+			for {
+				data, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					if !errors.Is(err, test.err) {
+						t.Fatalf("reader err = %v, want %v", err, test.err)
+					}
+					break
+				}
+				records = append(records, string(data))
+			}
+			if fmt.Sprint(records) != test.want {
+				t.Fatalf("reader records = %q, want %s", records, test.want)
+			}
+		})
+	}
+}
+
+func TestReadSegment(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithMaxSegments(100))
+	for _, batch := range [][]string{{"a", "b"}, {"c"}, {"d", "e"}} {
+		for _, record := range batch {
+			_, err := w.Write([]byte(record))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := w.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []string
+	err = w.ReadSegment(segments[1].Index, func(data []byte) error {
+		records = append(records, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(records) != "[c]" {
+		t.Fatalf("records = %q, want [c]", records)
+	}
+	err = w.ReadSegment(segments[len(segments)-1].Index+1, func([]byte) error { return nil })
+	if !errors.Is(err, ErrSegmentNotFound) {
+		t.Fatalf("err = %v, want ErrSegmentNotFound", err)
+	}
+}
+
+func TestEmptyRecords(t *testing.T) {
+	for name, algorithm := range map[string]ChecksumAlgorithm{
+		"ieee": ChecksumIEEE,
+		// An empty record at offset 0 must not look like zero padding.
+		"none": ChecksumNone,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := openWAL(t, dir, WithChecksum(algorithm))
+			for _, record := range []string{"", "a", ""} {
+				_, err := w.Write([]byte(record))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w = openWAL(t, dir, WithChecksum(algorithm))
+			var records [][]byte
+			err = w.Recover(func(data []byte) error {
+				records = append(records, data)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 3 || records[0] == nil || len(records[0]) != 0 || string(records[1]) != "a" {
+				t.Fatalf("records = %q, want two non-nil empty records around a", records)
+			}
+			offset, err := w.Write(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != 3 {
+				t.Fatalf("offset = %d, want 3", offset)
+			}
+		})
+	}
+}
+
+func TestMaxRecordSize(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts []Option
+		max  int
+	}{
+		{"configured", []Option{WithMaxRecordSize(10)}, 10},
+		{"defaults to what fits a segment", []Option{WithSegmentSize(100)}, 100 - int(minSegmentSize)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := openWAL(t, "", append([]Option{WithStorage(NewMemoryStorage())}, test.opts...)...)
+			_, err := w.Write(make([]byte, test.max))
+			if err != nil {
+				t.Fatalf("record at the limit: %v", err)
+			}
+			_, err = w.Write(make([]byte, test.max+1))
+			if err != ErrRecordTooLarge {
+				t.Fatalf("err = %v, want ErrRecordTooLarge", err)
+			}
+			_, err = w.WriteBatch([][]byte{{1}, make([]byte, test.max+1)})
+			if err != ErrRecordTooLarge {
+				t.Fatalf("batch err = %v, want ErrRecordTooLarge", err)
+			}
+			// Rejected records never take an offset.
+			offset, err := w.Write([]byte("next"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != 1 {
+				t.Fatalf("offset = %d, want 1", offset)
+			}
+		})
+	}
+	_, err := NewWithOptions("", WithStorage(NewMemoryStorage()), WithMaxRecordSize(-1))
+	if err != ErrInvalidRecordSize {
+		t.Fatalf("err = %v, want ErrInvalidRecordSize", err)
+	}
+}
+
+func TestLogDirWithTrailingSlash(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir+string(filepath.Separator), WithSegmentSize(64), WithMaxSegments(2))
+	writeNumbered(t, w, 20)
+	waitForPrune(t, w)
+	names, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("found %d segments, want retention to keep 2", len(names))
+	}
+	if filepath.Dir(w.CurrentSegment()) != dir {
+		t.Fatalf("active segment %s isn't directly in %s", w.CurrentSegment(), dir)
+	}
+	records := recoverAll(t, w)
+	if len(records) == 0 || records[len(records)-1] != "19" {
+		t.Fatalf("records = %q, want the newest ones", records)
+	}
+}
+
+func TestDiskFullWriteIsRolledBack(t *testing.T) {
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithSyncMode(SyncAlways))
+	writeNumbered(t, w, 2)
+	storage.limitSpace(5)
+	_, err := w.Write([]byte("this record won't fit"))
+	if !errors.Is(err, ErrDiskFull) || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("err = %v, want ErrDiskFull wrapping ENOSPC", err)
+	}
+	storage.limitSpace(-1)
+	offset, err := w.Write([]byte("2"))
+	if err != nil {
+		t.Fatalf("write after space freed: %v", err)
+	}
+	if offset != 2 {
+		t.Fatalf("offset = %d, want the failed record's offset 2", offset)
+	}
+	err = w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write([]byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := w.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("report = %+v, want no partial records", report)
+	}
+	if records := recoverAll(t, w); fmt.Sprint(records) != "[0 1 2 3]" {
+		t.Fatalf("records = %q, want [0 1 2 3]", records)
+	}
+	if stats := w.Stats(); stats.RecordsWritten != 4 || stats.CurrentOffset != 4 {
+		t.Fatalf("stats = %+v, want 4 records written", stats)
+	}
+}
+
+func TestDiskFullFlushIsRetried(t *testing.T) {
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithSyncPeriod(time.Hour))
+	writeNumbered(t, w, 2)
+	err := w.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeNumbered(t, w, 3)
+	space := int64(encodedSize(1)) + 3
+	storage.limitSpace(space)
+	n, err := w.SyncN()
+	if !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("err = %v, want ErrDiskFull", err)
+	}
+	if int64(n) != space {
+		t.Fatalf("SyncN = %d, want the %d bytes that fit", n, space)
+	}
+	storage.limitSpace(-1)
+	// The records were acknowledged, so they stay buffered and keep their
+	// offsets rather than being handed to new records.
+	offset, err := w.Write([]byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 5 {
+		t.Fatalf("offset = %d, want 5", offset)
+	}
+	if records := recoverAll(t, w); fmt.Sprint(records) != "[0 1 0 1 2 after]" {
+		t.Fatalf("records = %q, want [0 1 0 1 2 after]", records)
+	}
+}
+
+func TestDiskFullNeverReusesAcknowledgedOffsets(t *testing.T) {
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithSyncMode(SyncNever))
+	a, err := w.WriteLocated([]byte("A"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.limitSpace(0)
+	err = w.Sync()
+	if !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("err = %v, want ErrDiskFull", err)
+	}
+	storage.limitSpace(-1)
+	b, err := w.WriteLocated([]byte("B"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Offset == a.Offset || b.Position == a.Position {
+		t.Fatalf("B got %+v, the locator A already has", b)
+	}
+	for _, locator := range []Locator{a, b} {
+		data, err := w.ReadAt(locator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := w.Get(locator.Offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(got) || string(data) != []string{"A", "B"}[locator.Offset] {
+			t.Fatalf("offset %d read back %q and %q", locator.Offset, data, got)
+		}
+	}
+}
+
+func TestDiskFullBeforeHeaderIsFlushed(t *testing.T) {
+	storage := newTestStorage()
+	storage.limitSpace(4)
+	w := openWAL(t, "", WithStorage(storage))
+	_, err := w.Write([]byte("kept"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Sync()
+	if !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("err = %v, want ErrDiskFull", err)
+	}
+	storage.limitSpace(-1)
+	_, err = w.Write([]byte("too"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := recoverAll(t, w); fmt.Sprint(records) != "[kept too]" {
+		t.Fatalf("records = %q, want [kept too]", records)
+	}
+}
+
+func TestFailedCutNeverDuplicatesOffsets(t *testing.T) {
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithSyncMode(SyncAlways))
+	writeNumbered(t, w, 2)
+	// The record reaches the file but the fsync fails, and cutting it off
+	// again fails too.
+	storage.failSyncs(errors.New("injected sync failure"))
+	storage.failTruncates(errors.New("injected truncate failure"))
+	_, err := w.Write([]byte("stranded"))
+	if err == nil {
+		t.Fatal("write succeeded despite the failed sync")
+	}
+	storage.failSyncs(nil)
+	storage.failTruncates(nil)
+	_, err = w.Write([]byte("next"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[uint64]bool{}
+	err = w.RecoverDetailed(func(record Record) error {
+		if seen[record.Offset] {
+			t.Fatalf("offset %d recovered twice", record.Offset)
+		}
+		seen[record.Offset] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailedRollbackRotates(t *testing.T) {
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithSyncMode(SyncAlways))
+	writeNumbered(t, w, 2)
+	storage.limitSpace(5)
+	storage.failTruncates(errors.New("injected truncate failure"))
+	_, err := w.Write([]byte("partly written"))
+	if !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("err = %v, want ErrDiskFull", err)
+	}
+	storage.limitSpace(-1)
+	storage.failTruncates(nil)
+	// The partial record couldn't be cut off, so writing moves on to a new
+	// segment, skipping its offset, and readers stop at the end of the good
+	// records.
+	offset, err := w.Write([]byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 3 {
+		t.Fatalf("offset = %d, want 3", offset)
+	}
+	segments, err := w.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("got %d segments, want the write to rotate", len(segments))
+	}
+	if records := recoverAll(t, w); fmt.Sprint(records) != "[0 1 2]" {
+		t.Fatalf("records = %q, want [0 1 2]", records)
+	}
+}
+
+func TestRotateSplitsSegments(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithMaxSegments(3))
+	var segments []uint64
+	for i := 0; i < 5; i++ {
+		locator, err := w.WriteLocated([]byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, locator.Segment)
+		err = w.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < len(segments); i++ {
+		if segments[i] <= segments[i-1] {
+			t.Fatalf("records landed in segments %v, want one each", segments)
+		}
+	}
+	// Rotation prunes down to MaxSegments, the empty active one included.
+	waitForPrune(t, w)
+	if records := recoverAll(t, w); fmt.Sprint(records) != "[3 4]" {
+		t.Fatalf("records = %q, want [3 4]", records)
+	}
+	offset, err := w.Write([]byte("5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 5 {
+		t.Fatalf("offset = %d, want 5", offset)
+	}
+}
+
+// typedRecord is a record as RecoverTyped delivers it.
+type typedRecord struct {
+	recordType uint16
+	data       string
+}
+
+func TestWriteTypedRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	want := []typedRecord{{1, "SET a"}, {2, "DELETE a"}, {0, "untyped"}, {1, "SET b"}, {500, "custom"}}
+	for _, record := range want {
+		var err error
+		if record.recordType == 0 {
+			_, err = w.Write([]byte(record.data))
+		} else {
+			_, err = w.WriteTyped(record.recordType, []byte(record.data))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, dir)
+	var got []typedRecord
+	err = w.RecoverTyped(func(recordType uint16, data []byte) error {
+		got = append(got, typedRecord{recordType, string(data)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("records = %v, want %v", got, want)
+	}
+}
+
+func TestRecoverFiltered(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	types := []uint16{1, 2, 3, 1, 2, 3}
+	for i, recordType := range types {
+		_, err := w.WriteTyped(recordType, []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []typedRecord
+	err := w.RecoverFiltered([]uint16{1, 3}, func(recordType uint16, data []byte) error {
+		got = append(got, typedRecord{recordType, string(data)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[{1 0} {3 2} {1 3} {3 5}]" {
+		t.Fatalf("records = %v, want types 1 and 3 only", got)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Records that are filtered out are still checked.
+	corruptSegment(t, dir, 1, recordHeaderSize(segmentVersion))
+	w = openWAL(t, dir, WithRecoveryMode(RecoveryStrict))
+	err = w.RecoverFiltered([]uint16{1}, func(uint16, []byte) error { return nil })
+	if !errors.Is(err, ErrChecksumValidation) {
+		t.Fatalf("err = %v, want ErrChecksumValidation from the skipped record", err)
+	}
+}
+
+func TestRetentionKeepsActiveSegment(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir, WithSegmentSize(64), WithMaxSegments(1))
+	writeNumbered(t, w, 50)
+	waitForPrune(t, w)
+	_, err := os.Stat(w.CurrentSegment())
+	if err != nil {
+		t.Fatalf("active segment: %v", err)
+	}
+	records := recoverAll(t, w)
+	if len(records) == 0 || records[len(records)-1] != "49" {
+		t.Fatalf("records = %q, want the active segment's records", records)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, dir, WithSegmentSize(64), WithMaxSegments(1))
+	if reopened := recoverAll(t, w); fmt.Sprint(reopened) != fmt.Sprint(records) {
+		t.Fatalf("records after reopening = %q, want %q", reopened, records)
+	}
+}
+
+func TestCloseContextFinishesInBackground(t *testing.T) {
+	release := make(chan struct{})
+	storage := newTestStorage()
+	w, err := NewWithOptions("", WithStorage(storage), WithSyncPeriod(time.Hour),
+		WithOnRotate(func(SegmentMeta) error {
+			<-release
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write([]byte("buffered"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = w.CloseContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if err := w.Close(); err != ErrWALClosed {
+		t.Fatalf("second Close err = %v, want ErrWALClosed", err)
+	}
+	// Once the slow hook returns the segment is flushed and closed.
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for storage.openWriters() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("active segment left open after the hook returned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w = openWAL(t, "", WithStorage(storage))
+	if records := recoverAll(t, w); fmt.Sprint(records) != "[buffered]" {
+		t.Fatalf("records = %q, want the buffered record flushed", records)
+	}
+}
+
+func TestMethodsAfterCloseReturnErrWALClosed(t *testing.T) {
+	w := openWAL(t, "", WithStorage(NewMemoryStorage()))
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, call := range map[string]func() error{
+		"Write": func() error {
+			_, err := w.Write([]byte("a"))
+			return err
+		},
+		"WriteBatch": func() error {
+			_, err := w.WriteBatch([][]byte{[]byte("a")})
+			return err
+		},
+		"Sync":    w.Sync,
+		"Rotate":  w.Rotate,
+		"Recover": func() error { return w.Recover(func([]byte) error { return nil }) },
+		"Close":   w.Close,
+	} {
+		err := call()
+		if err != ErrWALClosed {
+			t.Errorf("%s after Close err = %v, want ErrWALClosed", name, err)
+		}
+	}
+}
+
+// TestConcurrentWritesAndReads is meant for go test -race: writers append
+// and rotate while readers replay through every read path.
+func TestConcurrentWritesAndReads(t *testing.T) {
+	w := openWAL(t, t.TempDir(), WithSegmentSize(512), WithMaxSegments(8),
+		WithIndexInterval(4), WithSyncPeriod(time.Millisecond),
+		WithOnRotate(func(SegmentMeta) error { return nil }))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	records, err := w.Follow(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range records {
+		}
+	}()
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	run := func(n int, op func(i int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				err := op(i)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	for writer := 0; writer < 2; writer++ {
+		run(300, func(i int) error {
+			_, err := w.Write([]byte(fmt.Sprint(i)))
+			return err
+		})
+	}
+	run(50, func(i int) error {
+		_, err := w.WriteBatch([][]byte{[]byte("a"), []byte("b")})
+		return err
+	})
+	run(10, func(int) error { return w.Rotate() })
+	run(30, func(int) error { return w.Recover(func([]byte) error { return nil }) })
+	run(30, func(int) error {
+		_, err := readAll(w)
+		return err
+	})
+	run(30, func(i int) error {
+		_, err := w.Get(uint64(i))
+		if err == ErrRecordNotFound {
+			return nil
+		}
+		return err
+	})
+	run(30, func(int) error { return w.Tail(5, func([]byte) error { return nil }) })
+	run(30, func(int) error { return w.RecoverReverse(func([]byte) error { return nil }) })
+	run(30, func(int) error {
+		_, err := w.Verify()
+		return err
+	})
+	run(30, func(int) error {
+		w.Stats()
+		w.CurrentSegment()
+		w.LastSyncError()
+		w.LastRetentionError()
+		_, err := w.Segments()
+		if err != nil {
+			return err
+		}
+		_, err = w.DiskUsage()
+		if err != nil {
+			return err
+		}
+		_, err = w.RecordCount()
+		return err
+	})
+	run(30, func(int) error { return w.Sync() })
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteStringMatchesWrite(t *testing.T) {
+	for name, codec := range map[string]Codec{"plain": nil, "gzip": GzipCodec{}} {
+		t.Run(name, func(t *testing.T) {
+			clock := newFakeClock()
+			var segments [2][]byte
+			for i, write := range []func(w *WAL, s string) (uint64, error){
+				func(w *WAL, s string) (uint64, error) { return w.Write([]byte(s)) },
+				(*WAL).WriteString,
+			} {
+				dir := t.TempDir()
+				w := openWAL(t, dir, WithClock(clock), WithCompression(codec))
+				for _, s := range []string{"SET X 23", "", strings.Repeat("DEL Y ", 50)} {
+					_, err := write(w, s)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				err := w.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				segments[i] = readSegmentFiles(t, dir)
+			}
+			if !bytes.Equal(segments[0], segments[1]) {
+				t.Fatal("WriteString and Write produced different segments")
+			}
+		})
+	}
+}
+
+// scribbleCodec overwrites its input, which Codec forbids.
+type scribbleCodec struct{}
+
+func (scribbleCodec) ID() byte {
+	return 2
+}
+
+func (scribbleCodec) Compress(data []byte) ([]byte, error) {
+	for i := range data {
+		data[i] = 'x'
+	}
+	return nil, nil
+}
+
+func (scribbleCodec) Decompress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func TestWriteStringCopiesForCodec(t *testing.T) {
+	w := openWAL(t, t.TempDir(), WithCompression(scribbleCodec{}))
+	s := strings.Repeat("a", 16)
+	_, err := w.WriteString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != strings.Repeat("a", 16) {
+		t.Fatalf("string modified to %q", s)
+	}
+}
+
+func TestPrefixedWALsShareDirectory(t *testing.T) {
+	dir := t.TempDir()
+	// The second prefix extends the first, which mustn't make its segments
+	// look like the first WAL's.
+	orders := openWAL(t, dir, WithPrefix("orders-"), WithSegmentSize(64), WithMaxSegments(2))
+	audit := openWAL(t, dir, WithPrefix("orders-audit-"), WithSegmentSize(64), WithMaxSegments(100))
+	for i := 0; i < 20; i++ {
+		_, err := orders.Write([]byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = audit.Write([]byte(fmt.Sprint("audit ", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForPrune(t, orders)
+	waitForPrune(t, audit)
+	if n := orders.Stats().Segments; n != 2 {
+		t.Fatalf("orders has %d segments, want 2", n)
+	}
+	for _, w := range []*WAL{orders, audit} {
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	audit = openWAL(t, dir, WithPrefix("orders-audit-"))
+	records := recoverAll(t, audit)
+	if len(records) != 20 || records[0] != "audit 0" || records[19] != "audit 19" {
+		t.Fatalf("audit records = %q, want its own 20", records)
+	}
+	orders = openWAL(t, dir, WithPrefix("orders-"))
+	for _, record := range recoverAll(t, orders) {
+		if strings.HasPrefix(record, "audit") {
+			t.Fatalf("orders recovered audit record %q", record)
+		}
+	}
+	offset, err := orders.Write([]byte("20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 20 {
+		t.Fatalf("orders offset = %d, want 20", offset)
+	}
+}
+
+func TestPrefixRejectsPathSeparators(t *testing.T) {
+	_, err := NewWithOptions(t.TempDir(), WithPrefix("nested/segment-"))
+	if !errors.Is(err, ErrInvalidPrefix) {
+		t.Fatalf("err = %v, want ErrInvalidPrefix", err)
+	}
+}
+
+func TestLoggerReportsCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir)
+	writeNumbered(t, w, 5)
+	segment := filepath.Base(w.CurrentSegment())
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptSegment(t, dir, 2, recordHeaderSize(segmentVersion))
+	var logged bytes.Buffer
+	w = openWAL(t, dir, WithLogger(slog.New(slog.NewJSONHandler(&logged, nil))))
+	logged.Reset()
+	recoverAll(t, w)
+	var event struct {
+		Level    string
+		Msg      string
+		Segment  string
+		Position int64
+	}
+	err = json.Unmarshal(logged.Bytes(), &event)
+	if err != nil {
+		t.Fatalf("logged %q: %v", logged.String(), err)
+	}
+	want := segmentHeaderSize + createdAtSize + 2*encodedSize(1)
+	if event.Level != "WARN" || event.Msg != "corrupt record" || event.Segment != segment || event.Position != want {
+		t.Fatalf("logged %+v, want a corrupt record warning for %s at %d", event, segment, want)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	writer := openWAL(t, dir, WithSegmentSize(64), WithMaxSegments(100))
+	writeNumbered(t, writer, 5)
+	err := writer.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := readSegmentFiles(t, dir)
+	reader, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if records := recoverAll(t, reader); fmt.Sprint(records) != "[0 1 2 3 4]" {
+		t.Fatalf("records = %q, want 0 to 4", records)
+	}
+	for name, write := range map[string]func() error{
+		"Write": func() error {
+			_, err := reader.Write([]byte("x"))
+			return err
+		},
+		"Rotate":         reader.Rotate,
+		"Sync":           reader.Sync,
+		"Drain":          reader.Drain,
+		"Purge":          reader.Purge,
+		"Compact":        reader.Compact,
+		"TruncateBefore": func() error { return reader.TruncateBefore(3) },
+	} {
+		err := write()
+		if !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("%s: err = %v, want ErrReadOnly", name, err)
+		}
+	}
+	if !bytes.Equal(readSegmentFiles(t, dir), before) {
+		t.Fatal("read-only WAL changed the segments")
+	}
+	// Reads list the segments afresh, so they see the writer's new records.
+	writeNumbered(t, writer, 2)
+	err = writer.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := recoverAll(t, reader); fmt.Sprint(records) != "[0 1 2 3 4 0 1]" {
+		t.Fatalf("records = %q, want the writer's later records too", records)
+	}
+}
+
+func TestWriteSyncFsyncsEachRecord(t *testing.T) {
+	for _, fsync := range []bool{true, false} {
+		t.Run(fmt.Sprint("fsync=", fsync), func(t *testing.T) {
+			storage := newTestStorage()
+			w := openWAL(t, "", WithStorage(storage), WithSyncMode(SyncNever), WithFsync(fsync))
+			for i := 1; i <= 3; i++ {
+				_, err := w.WriteSync([]byte("critical"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n := storage.fileSyncs(); n != i {
+					t.Fatalf("%d fsyncs after %d WriteSyncs, want %d", n, i, i)
+				}
+			}
+			_, err := w.Write([]byte("ordinary"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := storage.fileSyncs(); n != 3 {
+				t.Fatalf("%d fsyncs after a plain Write, want 3", n)
+			}
+		})
+	}
+}
+
+func TestDrainForBackup(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, dir, WithSegmentSize(64), WithMaxSegments(100), WithSyncMode(SyncNever))
+	writeNumbered(t, w, 5)
+	err := w.Drain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := t.TempDir()
+	names, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(backup, filepath.Base(name)), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	offset, err := w.Write([]byte("5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 5 {
+		t.Fatalf("offset after Drain = %d, want 5", offset)
+	}
+	if records := recoverAll(t, openWAL(t, backup)); fmt.Sprint(records) != "[0 1 2 3 4]" {
+		t.Fatalf("backup records = %q, want 0 to 4", records)
+	}
+	if records := recoverAll(t, w); fmt.Sprint(records) != "[0 1 2 3 4 5]" {
+		t.Fatalf("records = %q, want 0 to 5", records)
+	}
+}
+
+func TestDrainFsyncsWhenDisabled(t *testing.T) {
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithSyncMode(SyncNever), WithFsync(false))
+	_, err := w.Write([]byte("record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Drain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := storage.fileSyncs(); n != 1 {
+		t.Fatalf("%d fsyncs, want 1", n)
+	}
+	if n := storage.storageSyncs(); n != 1 {
+		t.Fatalf("%d storage syncs, want 1", n)
+	}
+}
+
+func TestRecoverDetailedChecksums(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		algorithm ChecksumAlgorithm
+		table     *crc32.Table
+	}{
+		{"ieee", ChecksumIEEE, crc32.IEEETable},
+		{"castagnoli", ChecksumCastagnoli, crc32.MakeTable(crc32.Castagnoli)},
+		{"none", ChecksumNone, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Compression shows the checksum covers the payload as
+			// delivered, not as stored.
+			w := openWAL(t, "", WithStorage(NewMemoryStorage()), WithChecksum(test.algorithm), WithCompression(GzipCodec{}))
+			want := []string{"a", "", strings.Repeat("compressible ", 20)}
+			for _, data := range want {
+				_, err := w.Write([]byte(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var i int
+			err := w.RecoverDetailed(func(record Record) error {
+				var checksum uint32
+				if test.table != nil {
+					checksum = crc32.Checksum([]byte(want[i]), test.table)
+				}
+				if record.Offset != uint64(i) || string(record.Data) != want[i] ||
+					record.Length != len(want[i]) || record.Checksum != checksum {
+					t.Fatalf("record %d = %+v, want checksum %#x", i, record, checksum)
+				}
+				i += 1
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i != len(want) {
+				t.Fatalf("recovered %d records, want %d", i, len(want))
+			}
+		})
+	}
+}
+
+func TestFailedRotationKeepsActiveSegment(t *testing.T) {
+	storage := newTestStorage()
+	w := openWAL(t, "", WithStorage(storage), WithSegmentSize(88), WithMaxSegments(100), WithSyncMode(SyncNever))
+	writeNumbered(t, w, 4)
+	first := w.CurrentSegment()
+	// The fifth write rotates, which first has to make the full segment
+	// durable.
+	injected := errors.New("fsync failed")
+	storage.failSyncs(injected)
+	for i := 0; i < 2; i++ {
+		_, err := w.Write([]byte("x"))
+		if !errors.Is(err, injected) {
+			t.Fatalf("err = %v, want the fsync error", err)
+		}
+		if w.CurrentSegment() != first {
+			t.Fatal("switched segments although the old one wasn't synced")
+		}
+	}
+	storage.failSyncs(nil)
+	offset, err := w.Write([]byte("4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 4 {
+		t.Fatalf("offset = %d, want 4", offset)
+	}
+	if w.CurrentSegment() == first {
+		t.Fatal("didn't rotate once the sync succeeded")
+	}
+	writeNumbered(t, w, 1)
+	var got []string
+	err = w.RecoverDetailed(func(record Record) error {
+		got = append(got, fmt.Sprintf("%d:%s", record.Offset, record.Data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[0:0 1:1 2:2 3:3 4:4 5:0]" {
+		t.Fatalf("records = %v, want every record once and in order", got)
+	}
+}
+
+func TestSyncNReportsFlushedBytes(t *testing.T) {
+	storage := NewMemoryStorage()
+	w := openWAL(t, "", WithStorage(storage), WithSyncMode(SyncNever))
+	name := filepath.Base(w.CurrentSegment())
+	syncN := func(want int64) {
+		t.Helper()
+		before, err := storage.Size(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := w.SyncN()
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := storage.Size(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(n) != want || after-before != want {
+			t.Fatalf("SyncN = %d and the segment grew %d bytes, want %d", n, after-before, want)
+		}
+	}
+	// The new segment's header is still buffered too.
+	writeNumbered(t, w, 3)
+	syncN(segmentHeaderSize + createdAtSize + 3*encodedSize(1))
+	syncN(0)
+	_, err := w.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncN(encodedSize(5))
+}